@@ -6,9 +6,7 @@ require (
 	github.com/rogpeppe/go-internal v1.14.1
 	golang.org/x/mod v0.27.0
 	golang.org/x/sync v0.16.0
+	golang.org/x/tools v0.35.0
 )
 
-require (
-	golang.org/x/sys v0.34.0 // indirect
-	golang.org/x/tools v0.35.0 // indirect
-)
+require golang.org/x/sys v0.34.0 // indirect
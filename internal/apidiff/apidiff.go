@@ -0,0 +1,343 @@
+// Package apidiff compares the exported API of two versions of a module.
+package apidiff
+
+import (
+	"fmt"
+	"go/types"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/tools/go/packages"
+
+	"github.com/icholy/gomajor/internal/modproxy"
+)
+
+// Change is a difference in the exported API of a package.
+type Change struct {
+	// Name is the changed identifier, which is qualified by the type name
+	// for methods and fields. For example, Client.Get.
+	// It's empty when the whole package was added or removed.
+	Name    string
+	Message string
+	// Compatible is false if code using the old API may not compile with the new one.
+	Compatible bool
+}
+
+// String returns the change in "name: message" form.
+func (c Change) String() string {
+	if c.Name == "" {
+		return c.Message
+	}
+	return c.Name + ": " + c.Message
+}
+
+// Package contains the changes to a package.
+type Package struct {
+	// Dir is the package directory relative to the module root.
+	Dir     string
+	Changes []Change
+}
+
+// Incompatible returns the incompatible changes.
+func (p Package) Incompatible() []Change {
+	var changes []Change
+	for _, c := range p.Changes {
+		if !c.Compatible {
+			changes = append(changes, c)
+		}
+	}
+	return changes
+}
+
+// Module is the type-checked API of a module version.
+// The packages are keyed by package directory.
+type Module map[string]*types.Package
+
+// Fetch downloads the module version from the module proxy and type-checks it.
+func Fetch(mod module.Version, cached bool) (Module, error) {
+	dir, err := os.MkdirTemp("", "gomajor-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "mod")
+	if err := modproxy.Download(mod, root, cached); err != nil {
+		return nil, err
+	}
+	return Load(root, mod.Path)
+}
+
+// Load type-checks the public packages of the module in dir.
+// Internal packages, commands, and testdata are skipped.
+// Missing requirements are downloaded by the go command.
+func Load(dir, modpath string) (Module, error) {
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedTypes | packages.NeedImports | packages.NeedDeps,
+		Dir:  dir,
+		Env:  append(os.Environ(), "GOFLAGS=-mod=mod", "GOWORK=off"),
+	}
+	pkgs, err := packages.Load(cfg, "./...")
+	if err != nil {
+		return nil, err
+	}
+	mod := Module{}
+	for _, pkg := range pkgs {
+		pkgdir, ok := strings.CutPrefix(pkg.PkgPath, modpath)
+		if !ok || pkg.Name == "main" || isInternal(pkgdir) {
+			continue
+		}
+		if len(pkg.Errors) > 0 {
+			return nil, fmt.Errorf("%s: %w", pkg.PkgPath, pkg.Errors[0])
+		}
+		mod[strings.TrimPrefix(pkgdir, "/")] = pkg.Types
+	}
+	return mod, nil
+}
+
+// isInternal reports whether the package directory is internal.
+func isInternal(pkgdir string) bool {
+	return slices.Contains(strings.Split(pkgdir, "/"), "internal")
+}
+
+// Diff compares the packages of the module versions.
+// Packages without changes are omitted, and the rest are sorted by directory.
+func Diff(old, new Module) []Package {
+	var diffs []Package
+	for dir, oldpkg := range old {
+		newpkg, ok := new[dir]
+		if !ok {
+			diffs = append(diffs, Package{Dir: dir, Changes: []Change{{Message: "package removed"}}})
+			continue
+		}
+		if changes := Compare(oldpkg, newpkg); len(changes) > 0 {
+			diffs = append(diffs, Package{Dir: dir, Changes: changes})
+		}
+	}
+	for dir := range new {
+		if _, ok := old[dir]; !ok {
+			diffs = append(diffs, Package{Dir: dir, Changes: []Change{{Message: "package added", Compatible: true}}})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Dir < diffs[j].Dir
+	})
+	return diffs
+}
+
+// Compare returns the changes to the exported API of the package.
+// Incompatible changes are listed first, and both groups are sorted by name.
+func Compare(old, new *types.Package) []Change {
+	var c comparer
+	oldscope, newscope := old.Scope(), new.Scope()
+	for _, name := range oldscope.Names() {
+		oldobj := oldscope.Lookup(name)
+		if !oldobj.Exported() {
+			continue
+		}
+		newobj := newscope.Lookup(name)
+		if newobj == nil {
+			c.removed(name)
+			continue
+		}
+		c.object(name, oldobj, newobj)
+	}
+	for _, name := range newscope.Names() {
+		if obj := newscope.Lookup(name); obj.Exported() && oldscope.Lookup(name) == nil {
+			c.added(name)
+		}
+	}
+	sort.SliceStable(c.changes, func(i, j int) bool {
+		ci, cj := c.changes[i], c.changes[j]
+		if ci.Compatible != cj.Compatible {
+			return !ci.Compatible
+		}
+		return ci.Name < cj.Name
+	})
+	return c.changes
+}
+
+// comparer collects changes.
+type comparer struct {
+	changes []Change
+}
+
+func (c *comparer) removed(name string) {
+	c.changes = append(c.changes, Change{Name: name, Message: "removed"})
+}
+
+func (c *comparer) added(name string) {
+	c.changes = append(c.changes, Change{Name: name, Message: "added", Compatible: true})
+}
+
+func (c *comparer) changed(name, from, to string) {
+	c.changes = append(c.changes, Change{Name: name, Message: fmt.Sprintf("changed from %s to %s", from, to)})
+}
+
+// object compares package-level objects with the same name.
+func (c *comparer) object(name string, oldobj, newobj types.Object) {
+	if kind(oldobj) != kind(newobj) {
+		c.changed(name, kind(oldobj), kind(newobj))
+		return
+	}
+	switch oldobj := oldobj.(type) {
+	case *types.Const:
+		newobj := newobj.(*types.Const)
+		if from, to := typeString(oldobj.Type()), typeString(newobj.Type()); from != to {
+			c.changed(name, from, to)
+		} else if from, to := oldobj.Val().ExactString(), newobj.Val().ExactString(); from != to {
+			c.changed(name, "value "+from, "value "+to)
+		}
+	case *types.TypeName:
+		if oldobj.IsAlias() || newobj.(*types.TypeName).IsAlias() {
+			if from, to := typeString(oldobj.Type()), typeString(newobj.Type()); from != to {
+				c.changed(name, from, to)
+			}
+			return
+		}
+		c.named(name, oldobj.Type(), newobj.Type())
+	default:
+		if from, to := typeString(oldobj.Type()), typeString(newobj.Type()); from != to {
+			c.changed(name, from, to)
+		}
+	}
+}
+
+// named compares the definitions, fields, and methods of named types.
+func (c *comparer) named(name string, oldtype, newtype types.Type) {
+	oldunder, newunder := oldtype.Underlying(), newtype.Underlying()
+	oldstruct, oldok := oldunder.(*types.Struct)
+	newstruct, newok := newunder.(*types.Struct)
+	switch {
+	case oldok && newok:
+		c.members(name, fields(oldstruct), fields(newstruct), false)
+	case isInterface(oldunder) && isInterface(newunder):
+		// adding methods to an interface breaks its implementations
+		c.members(name, interfaceMethods(oldunder), interfaceMethods(newunder), true)
+		return
+	default:
+		if from, to := typeString(oldunder), typeString(newunder); from != to {
+			c.changed(name, from, to)
+			return
+		}
+	}
+	newmethods := methods(types.NewPointer(newtype))
+	c.members(name, methods(types.NewPointer(oldtype)), newmethods, false)
+	// methods moved to a pointer receiver can't be called on values,
+	// and values no longer implement the interfaces which need them
+	newvalue := methods(newtype)
+	for member := range methods(oldtype) {
+		if _, ok := newvalue[member]; ok {
+			continue
+		}
+		if _, ok := newmethods[member]; ok {
+			c.changed(name+"."+member, "value receiver", "pointer receiver")
+		}
+	}
+}
+
+// members compares the exported fields or methods of a type.
+// If strict is set, added members are incompatible.
+func (c *comparer) members(typename string, oldmembers, newmembers map[string]string, strict bool) {
+	for member, from := range oldmembers {
+		name := typename + "." + member
+		to, ok := newmembers[member]
+		if !ok {
+			c.removed(name)
+		} else if from != to {
+			c.changed(name, from, to)
+		}
+	}
+	for member := range newmembers {
+		if _, ok := oldmembers[member]; ok {
+			continue
+		}
+		if strict {
+			c.changes = append(c.changes, Change{Name: typename + "." + member, Message: "added to interface"})
+		} else {
+			c.added(typename + "." + member)
+		}
+	}
+}
+
+// fields returns the type strings of the exported fields of the struct.
+func fields(st *types.Struct) map[string]string {
+	m := map[string]string{}
+	for i := range st.NumFields() {
+		if f := st.Field(i); f.Exported() {
+			m[f.Name()] = typeString(f.Type())
+		}
+	}
+	return m
+}
+
+// methods returns the signatures of the exported methods in the method set of the type.
+func methods(t types.Type) map[string]string {
+	m := map[string]string{}
+	mset := types.NewMethodSet(t)
+	for i := range mset.Len() {
+		if obj := mset.At(i).Obj(); obj.Exported() {
+			m[obj.Name()] = typeString(obj.Type())
+		}
+	}
+	return m
+}
+
+// interfaceMethods returns the signatures of the exported methods of the interface.
+func interfaceMethods(t types.Type) map[string]string {
+	m := map[string]string{}
+	iface := t.(*types.Interface)
+	for i := range iface.NumMethods() {
+		if f := iface.Method(i); f.Exported() {
+			m[f.Name()] = typeString(f.Type())
+		}
+	}
+	return m
+}
+
+// isInterface reports whether the underlying type is an interface.
+func isInterface(t types.Type) bool {
+	_, ok := t.(*types.Interface)
+	return ok
+}
+
+// kind returns the kind of the package-level object.
+func kind(obj types.Object) string {
+	switch obj.(type) {
+	case *types.Const:
+		return "const"
+	case *types.Var:
+		return "var"
+	case *types.Func:
+		return "func"
+	case *types.TypeName:
+		return "type"
+	default:
+		return "object"
+	}
+}
+
+// typeString formats the type for comparison. Packages are qualified by
+// name so types moving to a new major version path still compare equal,
+// and the parameter names of signatures are omitted.
+func typeString(t types.Type) string {
+	qualifier := func(pkg *types.Package) string {
+		return pkg.Name()
+	}
+	if sig, ok := t.(*types.Signature); ok {
+		t = types.NewSignatureType(nil, nil, nil, unnamed(sig.Params()), unnamed(sig.Results()), sig.Variadic())
+	}
+	return types.TypeString(t, qualifier)
+}
+
+// unnamed returns a copy of the tuple without variable names.
+func unnamed(tuple *types.Tuple) *types.Tuple {
+	vars := make([]*types.Var, tuple.Len())
+	for i := range vars {
+		vars[i] = types.NewParam(0, nil, "", tuple.At(i).Type())
+	}
+	return types.NewTuple(vars...)
+}
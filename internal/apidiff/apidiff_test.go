@@ -0,0 +1,110 @@
+package apidiff
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"reflect"
+	"testing"
+)
+
+func check(t *testing.T, path, src string) *types.Package {
+	t.Helper()
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "x.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := types.Config{Importer: importer.Default()}
+	pkg, err := conf.Check(path, fset, []*ast.File{f}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkg
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name    string
+		old     string
+		new     string
+		changes []string
+	}{
+		{
+			name: "unchanged",
+			old:  "package x; func F(a int) error { return nil }",
+			new:  "package x; func F(b int) error { return nil }",
+		},
+		{
+			name:    "func",
+			old:     "package x; func F(a int) {}; func G() {}",
+			new:     "package x; func F(a int, b string) {}; func H() {}",
+			changes: []string{"incompatible F: changed from func(int) to func(int, string)", "incompatible G: removed", "compatible H: added"},
+		},
+		{
+			name:    "kind",
+			old:     "package x; func F() {}",
+			new:     "package x; var F = func() {}",
+			changes: []string{"incompatible F: changed from func to var"},
+		},
+		{
+			name:    "const",
+			old:     "package x; const A = 1; const B int = 1",
+			new:     "package x; const A = 2; const B int64 = 1",
+			changes: []string{"incompatible A: changed from value 1 to value 2", "incompatible B: changed from int to int64"},
+		},
+		{
+			name: "struct",
+			old:  "package x; type T struct { A int; B string; c bool }; func (T) M() {}",
+			new:  "package x; type T struct { A int64; C string }; func (*T) M() {}; func (T) N() {}",
+			changes: []string{
+				"incompatible T.A: changed from int to int64",
+				"incompatible T.B: removed",
+				"incompatible T.M: changed from value receiver to pointer receiver",
+				"compatible T.C: added",
+				"compatible T.N: added",
+			},
+		},
+		{
+			name:    "interface",
+			old:     "package x; type I interface { M() }",
+			new:     "package x; type I interface { M(); N() }",
+			changes: []string{"incompatible I.N: added to interface"},
+		},
+		{
+			name:    "underlying",
+			old:     "package x; type T int",
+			new:     "package x; type T string",
+			changes: []string{"incompatible T: changed from int to string"},
+		},
+		{
+			name: "pointer to value receiver",
+			old:  "package x; type T struct{}; func (*T) M() {}",
+			new:  "package x; type T struct{}; func (T) M() {}",
+		},
+		{
+			name: "major version",
+			old:  "package x; type T struct{}; func New() *T { return nil }",
+			new:  "package x; type T struct{}; func New() *T { return nil }",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := check(t, "example.com/x", tt.old)
+			new := check(t, "example.com/x/v2", tt.new)
+			var changes []string
+			for _, c := range Compare(old, new) {
+				compat := "incompatible"
+				if c.Compatible {
+					compat = "compatible"
+				}
+				changes = append(changes, compat+" "+c.String())
+			}
+			if !reflect.DeepEqual(changes, tt.changes) {
+				t.Fatalf("changes:\n%q\nwant:\n%q", changes, tt.changes)
+			}
+		})
+	}
+}
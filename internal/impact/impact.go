@@ -0,0 +1,120 @@
+// Package impact estimates how much work a major version upgrade is.
+package impact
+
+import (
+	"go/token"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/tools/go/packages"
+
+	"github.com/icholy/gomajor/internal/apidiff"
+	"github.com/icholy/gomajor/internal/usage"
+)
+
+// ChangeWeight is the score of each distinct incompatible change which is used.
+// Every use of a changed identifier adds one more point, so a few changed
+// functions which are called a lot score lower than many changed functions.
+const ChangeWeight = 10
+
+// Site is a use of an identifier which was removed or changed incompatibly.
+type Site struct {
+	Pos token.Position
+	// Path is the import path of the package in the old version.
+	Path string
+	// Name is the used identifier, or empty for imports of removed packages.
+	Name   string
+	Change apidiff.Change
+}
+
+// Report is the impact of a major version upgrade on a project.
+type Report struct {
+	Sites []Site
+	// Changes is the number of distinct incompatible changes which are used.
+	Changes int
+	// Score estimates the difficulty of the upgrade.
+	Score int
+}
+
+// Upgrade returns the impact of upgrading the module on the type-checked packages.
+// Both versions are fetched from the module proxy, unless the module isn't used.
+func Upgrade(pkgs []*packages.Package, old, new module.Version, cached bool) (*Report, error) {
+	importers := usage.Collect(pkgs, usage.Options{ModPath: old.Path, Exact: true})
+	if len(importers) == 0 {
+		return &Report{}, nil
+	}
+	oldapi, err := apidiff.Fetch(old, cached)
+	if err != nil {
+		return nil, err
+	}
+	newapi, err := apidiff.Fetch(new, cached)
+	if err != nil {
+		return nil, err
+	}
+	return Analyze(old.Path, importers, apidiff.Diff(oldapi, newapi)), nil
+}
+
+// Analyze intersects the usage of the module with the changes made by the new version.
+// The modpath is the old module path, which the import paths of the usage start with.
+func Analyze(modpath string, importers []*usage.Importer, diffs []apidiff.Package) *Report {
+	changes := map[string][]apidiff.Change{}
+	for _, d := range diffs {
+		changes[d.Dir] = d.Incompatible()
+	}
+	var r Report
+	used := map[string]bool{}
+	add := func(path, dir, name string, positions []token.Position, c apidiff.Change) {
+		for _, pos := range positions {
+			r.Sites = append(r.Sites, Site{Pos: pos, Path: path, Name: name, Change: c})
+		}
+		used[dir+" "+c.Name] = true
+	}
+	for _, importer := range importers {
+		for _, imp := range importer.Imports {
+			dir, ok := pkgdir(modpath, imp.Path)
+			if !ok {
+				continue
+			}
+			for _, c := range changes[dir] {
+				if c.Name == "" {
+					// the package was removed
+					add(imp.Path, dir, "", imp.Positions, c)
+				}
+			}
+			for _, sym := range imp.Symbols {
+				for _, c := range changes[dir] {
+					if affects(c, sym.Name) {
+						add(imp.Path, dir, sym.Name, sym.Positions, c)
+						break
+					}
+				}
+			}
+		}
+	}
+	sort.SliceStable(r.Sites, func(i, j int) bool {
+		pi, pj := r.Sites[i].Pos, r.Sites[j].Pos
+		if pi.Filename != pj.Filename {
+			return pi.Filename < pj.Filename
+		}
+		return pi.Offset < pj.Offset
+	})
+	r.Changes = len(used)
+	r.Score = len(r.Sites) + ChangeWeight*r.Changes
+	return &r
+}
+
+// affects reports whether the change affects uses of the named identifier.
+// Changes to a type affect its methods and fields, and changes to a package affect everything in it.
+func affects(c apidiff.Change, name string) bool {
+	return c.Name == "" || c.Name == name || strings.HasPrefix(name, c.Name+".")
+}
+
+// pkgdir returns the package directory of the import path relative to the module.
+func pkgdir(modpath, path string) (string, bool) {
+	if path == modpath {
+		return "", true
+	}
+	dir, ok := strings.CutPrefix(path, modpath+"/")
+	return dir, ok
+}
@@ -0,0 +1,66 @@
+package impact
+
+import (
+	"go/token"
+	"reflect"
+	"testing"
+
+	"github.com/icholy/gomajor/internal/apidiff"
+	"github.com/icholy/gomajor/internal/usage"
+)
+
+func TestAnalyze(t *testing.T) {
+	pos := func(line int) []token.Position {
+		return []token.Position{{Filename: "main.go", Line: line, Offset: line * 100}}
+	}
+	importers := []*usage.Importer{
+		{
+			PkgPath: "example.com/app",
+			Imports: []*usage.Import{
+				{
+					Path:      "example.com/lib",
+					Positions: pos(1),
+					Symbols: []*usage.Symbol{
+						{Name: "Client.Get", Positions: append(pos(2), pos(3)...)},
+						{Name: "New", Positions: pos(4)},
+						{Name: "Options.Addr", Positions: pos(5)},
+					},
+				},
+				{
+					Path:      "example.com/lib/util",
+					Positions: pos(6),
+					Symbols:   []*usage.Symbol{{Name: "Join", Positions: pos(7)}},
+				},
+			},
+		},
+	}
+	diffs := []apidiff.Package{
+		{Dir: "", Changes: []apidiff.Change{
+			{Name: "Client.Get", Message: "changed"},
+			{Name: "Options", Message: "removed"},
+			{Name: "Ping", Message: "added", Compatible: true},
+		}},
+		{Dir: "util", Changes: []apidiff.Change{{Message: "package removed"}}},
+	}
+	r := Analyze("example.com/lib", importers, diffs)
+	var sites []string
+	for _, s := range r.Sites {
+		sites = append(sites, s.Pos.String()+" "+s.Name+" "+s.Change.String())
+	}
+	want := []string{
+		"main.go:2 Client.Get Client.Get: changed",
+		"main.go:3 Client.Get Client.Get: changed",
+		"main.go:5 Options.Addr Options: removed",
+		"main.go:6  package removed",
+		"main.go:7 Join package removed",
+	}
+	if !reflect.DeepEqual(sites, want) {
+		t.Fatalf("sites:\n%q\nwant:\n%q", sites, want)
+	}
+	if r.Changes != 3 {
+		t.Fatalf("changes = %d, want 3", r.Changes)
+	}
+	if want := len(want) + 3*ChangeWeight; r.Score != want {
+		t.Fatalf("score = %d, want %d", r.Score, want)
+	}
+}
@@ -0,0 +1,164 @@
+package importpaths
+
+import (
+	"bytes"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// task is a file processed by Rewrite.
+// The files are scanned for paths concurrently, the paths are replaced in
+// file order, and then the files with replacements are rewritten concurrently.
+type task struct {
+	name    string
+	rewrite rewriteFunc
+	// prefilter is true for regular Go files, which can be pre-filtered by their imports.
+	prefilter bool
+	src       []byte
+	// calls are the Replace calls made while scanning the file.
+	calls []replaceCall
+	// results are the return values of the calls.
+	results map[replaceKey]replaceResult
+	// perr is the parse error of a file which is partially rewritten in tolerant mode.
+	perr *scanner.Error
+	err  error
+	data []byte
+	ok   bool
+}
+
+// replaceCall is a recorded call to a ReplaceFunc.
+type replaceCall struct {
+	pos  token.Position
+	path string
+}
+
+// replaceKey identifies a call to a ReplaceFunc within a file.
+type replaceKey struct {
+	offset int
+	path   string
+}
+
+// replaceResult contains the return values of a ReplaceFunc.
+type replaceResult struct {
+	newpath string
+	err     error
+}
+
+// scan reads the file and records the paths which the rewrite func passes to Replace.
+// Go files which can't import a path matching opt.Match are only parsed up to their imports.
+func (t *task) scan(opt RewriteOptions) {
+	src, err := os.ReadFile(t.name)
+	if err != nil {
+		t.err = err
+		return
+	}
+	if opt.Match != nil && t.prefilter && !mayRewrite(t.name, src, opt.Match) {
+		return
+	}
+	sopt := opt
+	sopt.Replace = func(pos token.Position, path string) (string, error) {
+		t.calls = append(t.calls, replaceCall{pos: pos, path: path})
+		return "", ErrSkip
+	}
+	_, _, t.perr, t.err = rewriteTolerant(t.name, src, sopt, t.rewrite)
+	if len(t.calls) > 0 {
+		t.src = src
+	}
+}
+
+// replace calls opt.Replace with the recorded paths.
+// It returns false if Replace failed, in which case the file
+// must still be applied so the error is reported at its position.
+func (t *task) replace(opt RewriteOptions) bool {
+	for _, c := range t.calls {
+		newpath, err := opt.Replace(c.pos, c.path)
+		if t.results == nil {
+			t.results = map[replaceKey]replaceResult{}
+		}
+		t.results[replaceKey{offset: c.pos.Offset, path: c.path}] = replaceResult{newpath: newpath, err: err}
+		if err != nil && err != ErrSkip {
+			return false
+		}
+	}
+	return true
+}
+
+// apply rewrites the file using the results of replace.
+func (t *task) apply(opt RewriteOptions) {
+	if !t.replaced() {
+		return
+	}
+	aopt := opt
+	aopt.Replace = func(pos token.Position, path string) (string, error) {
+		r, ok := t.results[replaceKey{offset: pos.Offset, path: path}]
+		if !ok {
+			return "", ErrSkip
+		}
+		return r.newpath, r.err
+	}
+	// the parse error was already recorded by scan
+	t.data, t.ok, _, t.err = rewriteTolerant(t.name, t.src, aopt, t.rewrite)
+}
+
+// replaced reports whether any of the recorded paths were replaced or failed.
+func (t *task) replaced() bool {
+	for _, r := range t.results {
+		if r.err != ErrSkip {
+			return true
+		}
+	}
+	return false
+}
+
+// mayRewrite reports whether the Go src may need rewriting by only parsing its imports
+// and package clause import comment. Files with go:generate directives or imports
+// which don't parse are always included.
+func mayRewrite(name string, src []byte, match func(path string) bool) bool {
+	if bytes.Contains(src, []byte(generatePrefix)) {
+		return true
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, name, src, parser.ImportsOnly|parser.ParseComments)
+	if err != nil {
+		return true
+	}
+	if c := importComment(fset, file); c != nil {
+		path, err := strconv.Unquote(strings.TrimSpace(c.Text[len(importPrefix):]))
+		if err != nil || match(path) {
+			return true
+		}
+	}
+	for _, spec := range file.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil || match(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// parallel calls fn with the indices from 0 to n-1 using a pool of GOMAXPROCS goroutines.
+func parallel(n int, fn func(i int)) {
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for range min(n, runtime.GOMAXPROCS(0)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				fn(i)
+			}
+		}()
+	}
+	for i := range n {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+}
@@ -0,0 +1,28 @@
+package importpaths
+
+import (
+	"bytes"
+	"sort"
+)
+
+// edit replaces the bytes in the range [start, end) with text.
+type edit struct {
+	start, end int
+	text       string
+}
+
+// applyEdits returns a copy of src with the non-overlapping edits applied.
+func applyEdits(src []byte, edits []edit) []byte {
+	sort.SliceStable(edits, func(i, j int) bool {
+		return edits[i].start < edits[j].start
+	})
+	var buf bytes.Buffer
+	var last int
+	for _, e := range edits {
+		buf.Write(src[last:e.start])
+		buf.WriteString(e.text)
+		last = e.end
+	}
+	buf.Write(src[last:])
+	return buf.Bytes()
+}
@@ -0,0 +1,87 @@
+package importpaths
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// generatePrefix starts a go:generate directive.
+const generatePrefix = "//go:generate"
+
+// isGenerate reports whether the comment is a go:generate directive.
+// Like go generate, the directive must start at the beginning of the line
+// and be followed by a space or tab.
+func isGenerate(c *ast.Comment, pos token.Position) bool {
+	rest, ok := strings.CutPrefix(c.Text, generatePrefix)
+	return ok && pos.Column == 1 && (strings.HasPrefix(rest, " ") || strings.HasPrefix(rest, "\t"))
+}
+
+// generateEdits returns the edits which rewrite the package paths in a go:generate directive.
+// Arguments are separated by spaces and tabs, and quoted arguments are left alone.
+// A package path may be followed by an @version pin, which is passed to opt.Pin when
+// the path changes.
+func generateEdits(tf *token.File, c *ast.Comment, opt RewriteOptions) ([]edit, error) {
+	var edits []edit
+	text := c.Text
+	base := tf.Offset(c.Pos())
+	for i := len(generatePrefix); i < len(text); {
+		switch text[i] {
+		case ' ', '\t':
+			i++
+			continue
+		case '"':
+			// skip quoted strings
+			end := strings.IndexByte(text[i+1:], '"')
+			if end < 0 {
+				return edits, nil
+			}
+			i += end + 2
+			continue
+		}
+		end := strings.IndexAny(text[i:], " \t")
+		if end < 0 {
+			end = len(text)
+		} else {
+			end += i
+		}
+		word := text[i:end]
+		start := i
+		i = end
+		path, version, pinned := strings.Cut(word, "@")
+		if !isPackagePath(path) {
+			continue
+		}
+		pos := tf.PositionFor(c.Pos()+token.Pos(start), false)
+		newpath, err := opt.Replace(pos, path)
+		if err != nil {
+			if err == ErrSkip {
+				continue
+			}
+			return nil, fmt.Errorf("%s: %w", pos, err)
+		}
+		newword := newpath
+		if pinned {
+			if opt.Pin != nil {
+				version = opt.Pin(newpath, version)
+			}
+			newword += "@" + version
+		}
+		edits = append(edits, edit{
+			start: base + start,
+			end:   base + end,
+			text:  newword,
+		})
+	}
+	return edits, nil
+}
+
+// isPackagePath reports whether the go:generate argument looks like
+// the path of a package which can be downloaded.
+func isPackagePath(path string) bool {
+	first, _, _ := strings.Cut(path, "/")
+	return strings.Contains(first, ".") && module.CheckImportPath(path) == nil
+}
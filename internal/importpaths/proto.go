@@ -0,0 +1,54 @@
+package importpaths
+
+import (
+	"bytes"
+	"fmt"
+	"go/token"
+	"regexp"
+	"strings"
+)
+
+// goPackageOption matches go_package options in .proto files.
+// The first submatch is the import path, and the second is the optional ;name suffix.
+var goPackageOption = regexp.MustCompile(`(?m)^[ \t]*option[ \t]+go_package[ \t]*=[ \t]*"([^";]*)(;[^"]*)?"[ \t]*;`)
+
+// rewriteProto returns the rewritten contents of the .proto src.
+// The second return value is false if nothing was changed.
+// Only the import path portion of go_package options is changed,
+// so the ;name suffix and the rest of the file are preserved.
+func rewriteProto(name string, src []byte, opt RewriteOptions) ([]byte, bool, error) {
+	var edits []edit
+	for _, m := range goPackageOption.FindAllSubmatchIndex(src, -1) {
+		start, end := m[2], m[3]
+		pos := offsetPosition(name, src, start)
+		newpath, err := opt.Replace(pos, string(src[start:end]))
+		if err != nil {
+			if err == ErrSkip {
+				continue
+			}
+			return nil, false, fmt.Errorf("%s: %w", pos, err)
+		}
+		edits = append(edits, edit{start: start, end: end, text: newpath})
+	}
+	if len(edits) == 0 {
+		return nil, false, nil
+	}
+	return applyEdits(src, edits), true, nil
+}
+
+// offsetPosition returns the position of the byte offset in the file.
+func offsetPosition(name string, src []byte, offset int) token.Position {
+	before := src[:offset]
+	line := bytes.LastIndexByte(before, '\n') + 1
+	return token.Position{
+		Filename: name,
+		Offset:   offset,
+		Line:     bytes.Count(before, []byte("\n")) + 1,
+		Column:   offset - line + 1,
+	}
+}
+
+// isProto reports whether the named file is a protocol buffer definition.
+func isProto(name string) bool {
+	return strings.HasSuffix(name, ".proto")
+}
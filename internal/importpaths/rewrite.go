@@ -5,14 +5,19 @@ package importpaths
 import (
 	"errors"
 	"fmt"
+	"go/ast"
 	"go/parser"
-	"go/printer"
+	"go/scanner"
 	"go/token"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"unicode"
+
+	"golang.org/x/mod/semver"
 
 	"github.com/icholy/gomajor/internal/packages"
 )
@@ -24,148 +29,517 @@ var ErrSkip = errors.New("skip import")
 // if the second return parameter is false, the replacement doesn't happen
 type ReplaceFunc func(pos token.Position, path string) (string, error)
 
+// CommonOptions contains the options shared by Rewrite and RewriteModule.
+type CommonOptions struct {
+	// LocalPrefix is a comma-separated list of import path prefixes
+	// which are grouped after third-party imports (see goimports -local).
+	LocalPrefix string
+	// Proto enables rewriting the go_package options in .proto files.
+	Proto bool
+	// Text is a list of glob patterns for non-Go files, such as documentation
+	// and build scripts, whose package paths are rewritten. Patterns without a
+	// slash match file names, and the others match slash-separated paths
+	// relative to the rewritten directory.
+	Text []string
+	// Testdata enables rewriting testdata directories. The .go and go.mod
+	// files are rewritten, along with the embedded .go and go.mod files in
+	// txtar archives. Go files which don't parse are skipped.
+	Testdata bool
+	// Tolerant makes Rewrite keep going when Go files can't be parsed.
+	// The import declarations of files whose body doesn't parse are still
+	// rewritten. The parse errors are returned as ParseErrors once every
+	// other change has been written.
+	Tolerant bool
+	// Files limits the rewritten Go files to the named files, such as the
+	// files of the packages matching a pattern. Files outside the rewritten
+	// directory are ignored. If it's nil, every Go file is rewritten.
+	// Other files, such as .proto files and testdata, aren't affected.
+	Files []string
+}
+
+// RewriteOptions contains options for rewriting imports.
+type RewriteOptions struct {
+	CommonOptions
+	// Replace is called with every import path.
+	// Rewrite calls it from a single goroutine in file order.
+	Replace ReplaceFunc
+	// Match reports whether Replace may rewrite the path. If it's set,
+	// Go files are only fully parsed when one of their imports matches
+	// or they contain go:generate directives. It must be safe for concurrent use.
+	Match func(path string) bool
+	// Alias is called with the old and new paths of rewritten imports which
+	// don't have an explicit name. If it returns a non-empty string, it's
+	// added as the import's name. It must be safe for concurrent use.
+	Alias func(oldpath, newpath string) string
+	// Pin is called with the new path and version of rewritten package@version
+	// arguments in go:generate directives. It returns the new version.
+	// If it's nil, the version is kept. It must be safe for concurrent use.
+	Pin func(newpath, version string) string
+}
+
+// ParseErrors is returned when Tolerant is set and files couldn't be parsed.
+// It contains the first error of each file.
+type ParseErrors scanner.ErrorList
+
+// Error implements error
+func (e ParseErrors) Error() string {
+	return scanner.ErrorList(e).Error()
+}
+
+// ImportConflicts is returned when rewriting would make a file import the
+// same path with different names. Those files are skipped, and the other
+// changes are still written. It contains every conflict.
+type ImportConflicts scanner.ErrorList
+
+// Error implements error
+func (e ImportConflicts) Error() string {
+	return scanner.ErrorList(e).Error()
+}
+
 // Rewrite takes a directory path and a function for replacing imports paths
 // Note: underscore-prefix, dot-prefix, vendor, and submodule directories are skipped.
-func Rewrite(dir string, replace ReplaceFunc) error {
-	return filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+// Testdata directories are skipped unless opt.Testdata is set, and the modules in
+// them are treated as test fixtures instead of sub-modules.
+// Files are parsed and rewritten concurrently, but opt.Replace is called in file order.
+// Files are only written once every file has been processed successfully.
+// Files with import conflicts are skipped and returned as ImportConflicts.
+func Rewrite(dir string, opt RewriteOptions) error {
+	tasks, err := walk(dir, opt)
+	if err != nil {
+		return err
+	}
+	var tx txn
+	// find the paths in every file
+	parallel(len(tasks), func(i int) {
+		tasks[i].scan(opt)
+	})
+	// replace them in order
+	for i := range tasks {
+		t := &tasks[i]
+		if t.err != nil {
+			return t.err
+		}
+		if t.perr != nil {
+			tx.errs = append(tx.errs, t.perr)
+		}
+		if !t.replace(opt) {
+			tasks = tasks[:i+1]
+			break
+		}
+	}
+	// rewrite the files with replacements
+	parallel(len(tasks), func(i int) {
+		tasks[i].apply(opt)
+	})
+	for _, t := range tasks {
+		if tx.conflict(t.err) {
+			continue
+		}
+		if t.err != nil {
+			return t.err
+		}
+		if t.ok {
+			tx.files = append(tx.files, staged{name: t.name, orig: t.src, data: t.data})
+		}
+	}
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	return tx.skipped()
+}
+
+// walk returns the files in dir which Rewrite processes, in lexical order.
+func walk(dir string, opt RewriteOptions) ([]task, error) {
+	var tasks []task
+	scope, err := FileSet(opt.Files)
+	if err != nil {
+		return nil, err
+	}
+	add := func(name string, rewrite rewriteFunc) {
+		tasks = append(tasks, task{name: name, rewrite: rewrite})
+	}
+	err = packages.WalkModule(dir, packages.WalkOptions{Testdata: opt.Testdata}, func(name string, d fs.DirEntry, err error) error {
 		// check errors
 		if err != nil {
 			log.Println("import rewrite:", err)
 			return nil
 		}
-		// skip directories
-		if info.IsDir() {
-			if name == dir {
+		if d.IsDir() {
+			return nil
+		}
+		testdata := opt.Testdata && packages.InTestdata(dir, name)
+		if testdata {
+			switch {
+			case strings.HasSuffix(name, ".go"):
+				add(name, rewriteFixture)
+				return nil
+			case d.Name() == "go.mod":
+				add(name, rewriteGoMod)
+				return nil
+			case isTxtar(name):
+				add(name, rewriteTxtar)
 				return nil
 			}
-			// don't recurse into vendor, testdata, or node_modules directories
-			switch info.Name() {
-			case "vendor", "testdata", "node_modules":
-				return filepath.SkipDir
-			}
-			// don't recurse into underscore-prefix or dot-prefix directories
-			if strings.HasPrefix(info.Name(), ".") || strings.HasPrefix(info.Name(), "_") {
-				return filepath.SkipDir
-			}
-			// don't recurse into sub-modules
-			_, err := os.Lstat(filepath.Join(name, "go.mod"))
-			if err == nil {
-				return filepath.SkipDir
-			}
-			if !os.IsNotExist(err) {
-				log.Println("import rewrite:", err)
-				return filepath.SkipDir
-			}
-			return nil
 		}
 		// check the file is a .go file.
 		if strings.HasSuffix(name, ".go") {
-			return RewriteFile(name, replace)
+			if scope == nil || scope[absPath(name)] {
+				tasks = append(tasks, task{name: name, rewrite: rewriteFile, prefilter: true})
+			}
+			return nil
+		}
+		if opt.Proto && isProto(name) {
+			add(name, rewriteProto)
 		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	if len(opt.Text) > 0 {
+		names, err := textFiles(dir, opt.Text)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			// .proto files were already handled
+			if opt.Proto && isProto(name) {
+				continue
+			}
+			add(name, rewriteText)
+		}
+	}
+	return tasks, nil
+}
+
+// FileSet returns the set of absolute file names, or nil if names is nil.
+// It's used to scope changes to the Files of the options.
+func FileSet(names []string) (map[string]bool, error) {
+	if names == nil {
+		return nil, nil
+	}
+	set := map[string]bool{}
+	for _, name := range names {
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			return nil, err
+		}
+		set[abs] = true
+	}
+	return set, nil
+}
+
+// absPath returns the absolute form of name, or name if it can't be determined.
+func absPath(name string) string {
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return name
 }
 
 // RewriteFile rewrites import statments in the named file
 // according to the rules supplied by the map of strings.
-func RewriteFile(name string, replace ReplaceFunc) error {
+func RewriteFile(name string, opt RewriteOptions) error {
+	rewrite := rewriteFile
+	if isProto(name) {
+		rewrite = rewriteProto
+	}
+	var tx txn
+	if err := tx.rewrite(name, opt, rewrite); err != nil {
+		return err
+	}
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	return tx.skipped()
+}
+
+// rewriteFile returns the rewritten contents of the src.
+// The second return value is false if nothing was changed.
+// Package paths in go:generate directives are rewritten along with the imports.
+// Only the changed import paths are modified, the rest of the file
+// is left byte-for-byte identical. If the changes leave an import
+// block out of order, that block is re-sorted.
+func rewriteFile(name string, src []byte, opt RewriteOptions) ([]byte, bool, error) {
+	return rewriteGo(name, src, opt, parser.ParseComments)
+}
+
+// rewriteImports is like rewriteFile, but only the import declarations are parsed.
+// It's used for files whose body doesn't parse.
+func rewriteImports(name string, src []byte, opt RewriteOptions) ([]byte, bool, error) {
+	return rewriteGo(name, src, opt, parser.ImportsOnly|parser.ParseComments)
+}
+
+// rewriteGo rewrites the Go src after parsing it with the mode.
+func rewriteGo(name string, src []byte, opt RewriteOptions, mode parser.Mode) ([]byte, bool, error) {
 	// create an empty fileset.
 	fset := token.NewFileSet()
-	// parse the .go file.
-	// we are parsing the entire file with comments, so we don't lose anything
-	// if we need to write it back out.
-	f, err := parser.ParseFile(fset, name, nil, parser.ParseComments)
+	// parse the .go file with comments so we can find the import comment.
+	f, err := parser.ParseFile(fset, name, src, mode)
 	if err != nil {
-		return err
+		return nil, false, err
+	}
+	tf := fset.File(f.Pos())
+	// positions are reported without //line directives applied
+	// because they refer to locations in this file.
+	position := func(p token.Pos) token.Position {
+		return fset.PositionFor(p, false)
 	}
-	// iterate through the import paths. if a change occurs update bool.
-	change := false
+	var edits []edit
+	// iterate through the import paths and record any changes.
+	paths := map[*ast.ImportSpec]importRewrite{}
 	for _, i := range f.Imports {
-		pos := fset.Position(i.Pos())
+		pos := position(i.Pos())
 		// unquote the import path value.
 		path, err := strconv.Unquote(i.Path.Value)
 		if err != nil {
-			return fmt.Errorf("%s: %w", pos, err)
+			return nil, false, fmt.Errorf("%s: %w", pos, err)
 		}
 		// replace the value using the replace function
-		path, err = replace(pos, path)
+		newpath, err := opt.Replace(pos, path)
 		if err != nil {
 			if err == ErrSkip {
 				continue
 			}
-			return fmt.Errorf("%s: %w", pos, err)
+			return nil, false, fmt.Errorf("%s: %w", pos, err)
 		}
-		i.Path.Value = strconv.Quote(path)
-		change = true
+		rw := importRewrite{path: newpath}
+		if i.Name == nil && opt.Alias != nil {
+			rw.name = opt.Alias(path, newpath)
+		}
+		paths[i] = rw
+	}
+	// rewriting multiple major versions can create duplicate imports
+	drop, conflicts := duplicateImports(fset, f.Imports, paths)
+	if len(conflicts) > 0 {
+		return nil, false, conflicts
 	}
-	pkgpos := fset.Position(f.Package)
+	for _, d := range f.Decls {
+		if d, ok := d.(*ast.GenDecl); ok && d.Tok == token.IMPORT {
+			edits = append(edits, importEdits(tf, src, d, paths, drop, opt.LocalPrefix)...)
+		}
+	}
+	ic := importComment(fset, f)
 	for _, cg := range f.Comments {
 		for _, c := range cg.List {
-			pos := fset.Position(c.Pos())
-			const prefix = "// import "
-			if pos.Line == pkgpos.Line && strings.HasPrefix(c.Text, prefix) {
+			pos := position(c.Pos())
+			if isGenerate(c, pos) {
+				gen, err := generateEdits(tf, c, opt)
+				if err != nil {
+					return nil, false, err
+				}
+				edits = append(edits, gen...)
+				continue
+			}
+			if c == ic {
 				// trim off extra comment stuff
-				ctext := strings.TrimSpace(c.Text[len(prefix):])
+				rest := c.Text[len(importPrefix):]
+				quoted := strings.TrimSpace(rest)
 				// unquote the comment import path value
-				ctext, err := strconv.Unquote(ctext)
+				ctext, err := strconv.Unquote(quoted)
 				if err != nil {
-					return fmt.Errorf("%s: %v", pos, err)
+					return nil, false, fmt.Errorf("%s: %v", pos, err)
 				}
 				// match the comment import path with the given replacement map
-				ctext, err = replace(pos, ctext)
+				ctext, err = opt.Replace(pos, ctext)
 				if err != nil {
 					if err == ErrSkip {
 						continue
 					}
-					return fmt.Errorf("%s: %w", pos, err)
+					return nil, false, fmt.Errorf("%s: %w", pos, err)
 				}
-				c.Text = prefix + strconv.Quote(ctext)
-				change = true
+				start := tf.Offset(c.Pos()) + len(importPrefix) + len(rest) - len(strings.TrimLeftFunc(rest, unicode.IsSpace))
+				edits = append(edits, edit{
+					start: start,
+					end:   start + len(quoted),
+					text:  strconv.Quote(ctext),
+				})
 			}
 		}
 	}
 	// if no change occured, then we don't need to write to disk, just return.
-	if !change {
-		return nil
+	if len(edits) == 0 {
+		return nil, false, nil
 	}
-	// create a temporary file, this easily avoids conflicts.
-	temp := name + ".temp"
-	w, err := os.Create(temp)
-	if err != nil {
-		return err
+	return applyEdits(src, edits), true, nil
+}
+
+// importPrefix starts the import comment of a package clause.
+const importPrefix = "// import "
+
+// importComment returns the import comment on the line of the package clause,
+// or nil if there isn't one. The file must be parsed with comments.
+func importComment(fset *token.FileSet, f *ast.File) *ast.Comment {
+	line := fset.PositionFor(f.Package, false).Line
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			if fset.PositionFor(c.Pos(), false).Line == line && strings.HasPrefix(c.Text, importPrefix) {
+				return c
+			}
+		}
 	}
-	defer w.Close()
-	// preserve permissions
-	info, err := os.Lstat(name)
+	return nil
+}
+
+// txn is a set of file changes which are written together.
+type txn struct {
+	files []staged
+	// errs are the parse errors of the skipped files in tolerant mode.
+	errs scanner.ErrorList
+	// conflicts are the import conflicts of the skipped files.
+	conflicts scanner.ErrorList
+}
+
+// staged is a pending file change.
+type staged struct {
+	name string
+	orig []byte
+	data []byte
+}
+
+// rewriteFunc returns the rewritten contents of a file.
+// The second return value is false if nothing was changed.
+type rewriteFunc func(name string, src []byte, opt RewriteOptions) ([]byte, bool, error)
+
+// rewrite stages the changes made by the rewrite func to the named file.
+func (t *txn) rewrite(name string, opt RewriteOptions, rewrite rewriteFunc) error {
+	src, err := os.ReadFile(name)
 	if err != nil {
 		return err
 	}
-	if err := w.Chmod(info.Mode()); err != nil {
-		return err
+	data, ok, perr, err := rewriteTolerant(name, src, opt, rewrite)
+	if perr != nil {
+		t.errs = append(t.errs, perr)
 	}
-	// write changes to .temp file, and include proper formatting.
-	cfg := &printer.Config{
-		Mode:     printer.TabIndent | printer.UseSpaces,
-		Tabwidth: 8,
+	if t.conflict(err) {
+		return nil
 	}
-	if err := cfg.Fprint(w, fset, f); err != nil {
+	if err != nil || !ok {
 		return err
 	}
-	// close the writer
-	if err := w.Close(); err != nil {
-		return err
+	t.files = append(t.files, staged{name: name, orig: src, data: data})
+	return nil
+}
+
+// rewriteTolerant calls rewrite with the src. In tolerant mode, the import
+// declarations of Go files which don't parse are still rewritten, and the
+// parse error is returned as the third value instead of the error.
+func rewriteTolerant(name string, src []byte, opt RewriteOptions, rewrite rewriteFunc) ([]byte, bool, *scanner.Error, error) {
+	data, ok, err := rewrite(name, src, opt)
+	var list scanner.ErrorList
+	if opt.Tolerant && errors.As(err, &list) && len(list) > 0 {
+		perr := list[0]
+		// the import declarations may still be rewritten
+		data, ok, err = rewriteImports(name, src, opt)
+		if errors.As(err, &list) {
+			return nil, false, perr, nil
+		}
+		return data, ok, perr, err
 	}
-	// rename the .temp to .go
-	return os.Rename(temp, name)
+	return data, ok, nil, err
+}
+
+// conflict records the import conflicts if err contains them.
+// It reports whether the file should be skipped.
+func (t *txn) conflict(err error) bool {
+	var conflicts ImportConflicts
+	if !errors.As(err, &conflicts) {
+		return false
+	}
+	t.conflicts = append(t.conflicts, conflicts...)
+	return true
+}
+
+// skipped returns the collected parse errors and import conflicts,
+// or nil if there aren't any.
+func (t *txn) skipped() error {
+	var errs []error
+	if len(t.errs) > 0 {
+		errs = append(errs, ParseErrors(t.errs))
+	}
+	if len(t.conflicts) > 0 {
+		errs = append(errs, ImportConflicts(t.conflicts))
+	}
+	return errors.Join(errs...)
+}
+
+// commit writes all the staged files.
+// If any write fails, the files which were already written are restored.
+// Files are written in place so no temporary files are left behind
+// and permissions are preserved.
+func (t *txn) commit() error {
+	for i, s := range t.files {
+		if err := os.WriteFile(s.name, s.data, 0); err != nil {
+			return errors.Join(err, t.rollback(i+1))
+		}
+	}
+	return nil
+}
+
+// rollback restores the original contents of the first n staged files.
+func (t *txn) rollback(n int) error {
+	var errs []error
+	for _, s := range t.files[:n] {
+		if err := os.WriteFile(s.name, s.orig, 0); err != nil {
+			errs = append(errs, fmt.Errorf("rollback: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FileChange is a pending change to the contents of a file.
+type FileChange struct {
+	Name string
+	// Orig is the original contents, which are restored if the change is rolled back.
+	Orig []byte
+	Data []byte
+}
+
+// WriteFiles writes the changed files together. If any write fails,
+// the files which were already written are restored.
+func WriteFiles(changes []FileChange) error {
+	var tx txn
+	for _, c := range changes {
+		tx.files = append(tx.files, staged{name: c.Name, orig: c.Orig, data: c.Data})
+	}
+	return tx.commit()
 }
 
 // RewriteModuleOptions contains options for rewriting a module's imports.
 type RewriteModuleOptions struct {
+	CommonOptions
 	Prefix     string
 	NewVersion string
 	NewPrefix  string
 	PkgDir     string
 	OnRewrite  func(pos token.Position, oldpath, newpath string) error
+	// OldPkgNames and NewPkgNames map the import paths of the packages in the
+	// old and new versions of the module to their declared names. OldPkgNames
+	// contains every old major version, since they can be imported together.
+	// When a package's name changes, an import alias with the old
+	// name is added so the importing code continues to compile.
+	OldPkgNames map[string]string
+	NewPkgNames map[string]string
+}
+
+// ModuleMatcher matches the import paths of a module's packages.
+type ModuleMatcher struct {
+	// Prefix is the module path without a major version suffix.
+	// Every major version of the module is matched.
+	Prefix string
+	// PkgDir limits the matched packages to a single package directory.
+	// If it's empty, every package is matched.
+	PkgDir string
+}
+
+// Match splits the import path into the module path and package directory.
+// The last return value is false if the path isn't a package of the module.
+func (m ModuleMatcher) Match(path string) (modpath, pkgdir string, ok bool) {
+	modpath, pkgdir, ok = packages.SplitPath(m.Prefix, path)
+	if !ok || m.PkgDir != "" && m.PkgDir != pkgdir {
+		return "", "", false
+	}
+	return modpath, pkgdir, true
 }
 
 // RewriteModule rewrites imports of a specific module to a new version or prefix.
@@ -175,14 +549,13 @@ func RewriteModule(dir string, opt RewriteModuleOptions) error {
 	if opt.NewPrefix != "" {
 		modprefix = opt.NewPrefix
 	}
-	return Rewrite(dir, func(pos token.Position, path string) (string, error) {
-		_, pkgdir, ok := packages.SplitPath(opt.Prefix, path)
+	matcher := ModuleMatcher{Prefix: opt.Prefix, PkgDir: opt.PkgDir}
+	ropt := RewriteOptions{CommonOptions: opt.CommonOptions}
+	ropt.Replace = func(pos token.Position, path string) (string, error) {
+		_, pkgdir, ok := matcher.Match(path)
 		if !ok {
 			return "", ErrSkip
 		}
-		if opt.PkgDir != "" && opt.PkgDir != pkgdir {
-			return "", ErrSkip
-		}
 		newpath := packages.JoinPath(modprefix, opt.NewVersion, pkgdir)
 		if newpath == path {
 			return "", ErrSkip
@@ -193,5 +566,52 @@ func RewriteModule(dir string, opt RewriteModuleOptions) error {
 			}
 		}
 		return newpath, nil
-	})
+	}
+	ropt.Match = func(path string) bool {
+		_, _, ok := matcher.Match(path)
+		return ok
+	}
+	ropt.Pin = func(newpath, version string) string {
+		return pinVersion(modprefix, opt.NewVersion, newpath, version)
+	}
+	if opt.NewPkgNames != nil {
+		ropt.Alias = func(oldpath, newpath string) string {
+			newname, ok := opt.NewPkgNames[newpath]
+			if !ok {
+				return ""
+			}
+			oldname, ok := opt.OldPkgNames[oldpath]
+			if !ok {
+				oldname = packages.GuessName(oldpath)
+			}
+			if oldname == newname {
+				return ""
+			}
+			return oldname
+		}
+	}
+	return Rewrite(dir, ropt)
+}
+
+// pinVersion returns the version to pin a rewritten package path to.
+// Queries which aren't semantic versions, like latest, are kept. If the new
+// version is a complete semantic version, it's used. Otherwise, the pinned
+// version is kept if it's compatible with the new path, and it's replaced
+// with latest if it isn't.
+func pinVersion(modprefix, newversion, newpath, version string) string {
+	if !semver.IsValid(version) {
+		return version
+	}
+	if semver.IsValid(newversion) && semver.Canonical(newversion) == strings.TrimSuffix(newversion, "+incompatible") {
+		return newversion
+	}
+	modpath, _, _ := packages.SplitPath(modprefix, newpath)
+	if major, _ := packages.ModMajor(modpath); major != "" {
+		if semver.Major(version) == major {
+			return version
+		}
+	} else if semver.Major(version) == "v0" || semver.Major(version) == "v1" || semver.Build(version) == "+incompatible" {
+		return version
+	}
+	return "latest"
 }
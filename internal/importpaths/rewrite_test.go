@@ -2,9 +2,14 @@ package importpaths
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"go/parser"
 	"go/token"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -12,7 +17,10 @@ func TestRewriteFile(t *testing.T) {
 	tests := []struct {
 		input   string
 		expect  string
+		local   string
 		replace ReplaceFunc
+		alias   func(oldpath, newpath string) string
+		pin     func(newpath, version string) string
 	}{
 		{
 			input:  "testdata/a.go",
@@ -41,6 +49,96 @@ func TestRewriteFile(t *testing.T) {
 				return "", ErrSkip
 			},
 		},
+		{
+			input:  "testdata/b.go",
+			expect: "testdata/b_expect.go",
+			replace: func(pos token.Position, path string) (string, error) {
+				if path == "github.com/foo/a" {
+					return "github.com/bar/a", nil
+				}
+				return "", ErrSkip
+			},
+		},
+		{
+			input:  "testdata/c.go",
+			expect: "testdata/c_expect.go",
+			replace: func(pos token.Position, path string) (string, error) {
+				if path == "github.com/foo/a" {
+					return "github.com/bar/a", nil
+				}
+				return "", ErrSkip
+			},
+		},
+		{
+			input:  "testdata/d.go",
+			expect: "testdata/d_expect.go",
+			replace: func(pos token.Position, path string) (string, error) {
+				if path == "github.com/foo/a" {
+					return "github.com/bar/a", nil
+				}
+				return "", ErrSkip
+			},
+		},
+		{
+			input:  "testdata/e.go",
+			expect: "testdata/e_expect_0.go",
+			replace: func(pos token.Position, path string) (string, error) {
+				if path == "github.com/foo/a" {
+					return "github.com/zoo/a", nil
+				}
+				return "", ErrSkip
+			},
+		},
+		{
+			input:  "testdata/e.go",
+			expect: "testdata/e_expect_1.go",
+			local:  "example.com/local",
+			replace: func(pos token.Position, path string) (string, error) {
+				if path == "github.com/foo/b" {
+					return "example.com/local/b", nil
+				}
+				return "", ErrSkip
+			},
+		},
+		{
+			input:  "testdata/f.go",
+			expect: "testdata/f_expect.go",
+			replace: func(pos token.Position, path string) (string, error) {
+				if path == "github.com/foo/redis/v8" {
+					return "github.com/foo/redis/v9", nil
+				}
+				return "", ErrSkip
+			},
+		},
+		{
+			input:  "testdata/h.go",
+			expect: "testdata/h_expect.go",
+			replace: func(pos token.Position, path string) (string, error) {
+				if path == "github.com/foo/yaml" {
+					return "github.com/foo/yaml/v3", nil
+				}
+				return "", ErrSkip
+			},
+			alias: func(oldpath, newpath string) string {
+				return "yaml"
+			},
+		},
+		{
+			input:  "testdata/i.go",
+			expect: "testdata/i_expect.go",
+			replace: func(pos token.Position, path string) (string, error) {
+				if rest, ok := strings.CutPrefix(path, "github.com/foo/gen"); ok && (rest == "" || rest[0] == '/') {
+					return "github.com/foo/gen/v2" + rest, nil
+				}
+				return "", ErrSkip
+			},
+			pin: func(newpath, version string) string {
+				if version == "v1.2.0" {
+					return "v2.0.0"
+				}
+				return version
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run("", func(t *testing.T) {
@@ -52,7 +150,12 @@ func TestRewriteFile(t *testing.T) {
 			if err := os.WriteFile(name, input, 0755); err != nil {
 				t.Fatalf("write input: %v", err)
 			}
-			if err := RewriteFile(name, tt.replace); err != nil {
+			if err := RewriteFile(name, RewriteOptions{
+				CommonOptions: CommonOptions{LocalPrefix: tt.local},
+				Replace:       tt.replace,
+				Alias:         tt.alias,
+				Pin:           tt.pin,
+			}); err != nil {
 				t.Fatalf("rewrite: %v", err)
 			}
 			actual, err := os.ReadFile(name)
@@ -69,3 +172,583 @@ func TestRewriteFile(t *testing.T) {
 		})
 	}
 }
+
+func TestRewriteAtomic(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.go": "package a\n\nimport \"github.com/foo/a\"\n",
+		"b.go": "package a\n\nimport \"github.com/foo/a\"\n\nfunc {\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := Rewrite(dir, RewriteOptions{Replace: func(pos token.Position, path string) (string, error) {
+		return "github.com/bar/a", nil
+	}})
+	if err == nil {
+		t.Fatal("expected parse error")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(files) {
+		t.Fatalf("expected %d files, got %d", len(files), len(entries))
+	}
+	for name, expect := range files {
+		actual, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != expect {
+			t.Fatalf("%s: expected:\n%s\nactual:\n%s", name, expect, actual)
+		}
+	}
+}
+
+func TestRewriteFileConflict(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "g.go")
+	input, err := os.ReadFile("testdata/g.go")
+	if err != nil {
+		t.Fatalf("read input: %v", err)
+	}
+	if err := os.WriteFile(name, input, 0755); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+	err = RewriteFile(name, RewriteOptions{
+		Replace: func(pos token.Position, path string) (string, error) {
+			if path == "github.com/foo/redis/v8" {
+				return "github.com/foo/redis/v9", nil
+			}
+			return "", ErrSkip
+		},
+	})
+	var conflicts ImportConflicts
+	if !errors.As(err, &conflicts) {
+		t.Fatalf("expected import conflicts, got %v", err)
+	}
+	t.Log(err)
+	actual, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("read actual: %v", err)
+	}
+	if !bytes.Equal(actual, input) {
+		t.Fatalf("file was modified:\n%s", actual)
+	}
+}
+
+func TestRewriteConflictSkipped(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.go": "package a\n\nimport \"github.com/foo/redis/v8\"\n",
+		"b.go": "package a\n\nimport (\n\tredisv8 \"github.com/foo/redis/v8\"\n\t\"github.com/foo/redis/v9\"\n)\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := Rewrite(dir, RewriteOptions{
+		Replace: func(pos token.Position, path string) (string, error) {
+			if path == "github.com/foo/redis/v8" {
+				return "github.com/foo/redis/v9", nil
+			}
+			return "", ErrSkip
+		},
+	})
+	var conflicts ImportConflicts
+	if !errors.As(err, &conflicts) {
+		t.Fatalf("expected import conflicts, got %v", err)
+	}
+	var skipped []string
+	for _, e := range conflicts {
+		skipped = append(skipped, fmt.Sprintf("%s:%d", filepath.Base(e.Pos.Filename), e.Pos.Line))
+	}
+	if want := []string{"b.go:4"}; !reflect.DeepEqual(skipped, want) {
+		t.Fatalf("skipped = %v, want %v", skipped, want)
+	}
+	for name, expect := range map[string]string{
+		"a.go": "package a\n\nimport \"github.com/foo/redis/v9\"\n",
+		"b.go": files["b.go"],
+	} {
+		actual, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != expect {
+			t.Fatalf("%s: expected:\n%s\nactual:\n%s", name, expect, actual)
+		}
+	}
+}
+
+func TestRewriteModulePkgNames(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod": "module example.com/root\n",
+		"a.go":   "package a\n\nimport \"github.com/foo/mod\"\n",
+		"b.go":   "package a\n\nimport \"github.com/foo/mod/v2\"\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := RewriteModule(dir, RewriteModuleOptions{
+		Prefix:     "github.com/foo/mod",
+		NewVersion: "v3.0.0",
+		OldPkgNames: map[string]string{
+			"github.com/foo/mod":    "foo",
+			"github.com/foo/mod/v2": "mod",
+		},
+		NewPkgNames: map[string]string{
+			"github.com/foo/mod/v3": "mod",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expect := range map[string]string{
+		"a.go": "package a\n\nimport foo \"github.com/foo/mod/v3\"\n",
+		"b.go": "package a\n\nimport \"github.com/foo/mod/v3\"\n",
+	} {
+		actual, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != expect {
+			t.Fatalf("%s: expected:\n%s\nactual:\n%s", name, expect, actual)
+		}
+	}
+}
+
+func TestRewriteModuleImportComment(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "foo.go")
+	if err := os.WriteFile(name, []byte("package foo // import \"example.com/foo\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var rewrites []string
+	err := RewriteModule(dir, RewriteModuleOptions{
+		Prefix:     "example.com/foo",
+		NewVersion: "v2.0.0",
+		OnRewrite: func(pos token.Position, _, newpath string) error {
+			rewrites = append(rewrites, fmt.Sprintf("%s:%d:%d %s", filepath.Base(pos.Filename), pos.Line, pos.Column, newpath))
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"foo.go:1:13 example.com/foo/v2"}; !reflect.DeepEqual(rewrites, want) {
+		t.Fatalf("rewrites = %v, want %v", rewrites, want)
+	}
+	actual, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := "package foo // import \"example.com/foo/v2\"\n"; string(actual) != expect {
+		t.Fatalf("expected:\n%s\nactual:\n%s", expect, actual)
+	}
+}
+
+func TestPinVersion(t *testing.T) {
+	tests := []struct {
+		newversion string
+		newpath    string
+		version    string
+		want       string
+	}{
+		{newversion: "v3.1.0", newpath: "github.com/foo/gen/v3/cmd/x", version: "v2.0.0", want: "v3.1.0"},
+		{newversion: "v3", newpath: "github.com/foo/gen/v3/cmd/x", version: "v2.0.0", want: "latest"},
+		{newversion: "v3", newpath: "github.com/foo/gen/v3/cmd/x", version: "v3.2.0", want: "v3.2.0"},
+		{newversion: "v3", newpath: "github.com/foo/gen/v3", version: "master", want: "master"},
+		{newversion: "v1", newpath: "github.com/foo/gen/cmd/x", version: "v1.4.0", want: "v1.4.0"},
+		{newversion: "v1", newpath: "github.com/foo/gen/cmd/x", version: "v2.0.0", want: "latest"},
+		{newversion: "v2.0.0+incompatible", newpath: "github.com/foo/gen", version: "v1.0.0", want: "v2.0.0+incompatible"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.newpath+"@"+tt.version, func(t *testing.T) {
+			if got := pinVersion("github.com/foo/gen", tt.newversion, tt.newpath, tt.version); got != tt.want {
+				t.Fatalf("pinVersion(%q, %q, %q) = %q, want %q", tt.newversion, tt.newpath, tt.version, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteProto(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "j.proto")
+	input, err := os.ReadFile("testdata/j.proto")
+	if err != nil {
+		t.Fatalf("read input: %v", err)
+	}
+	if err := os.WriteFile(name, input, 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+	var rewritten []string
+	err = RewriteFile(name, RewriteOptions{
+		Replace: func(pos token.Position, path string) (string, error) {
+			rest, ok := strings.CutPrefix(path, "github.com/foo/api/")
+			if !ok {
+				return "", ErrSkip
+			}
+			rewritten = append(rewritten, fmt.Sprintf("%d:%d", pos.Line, pos.Column))
+			return "github.com/foo/api/v2/" + rest, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+	actual, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("read actual: %v", err)
+	}
+	expect, err := os.ReadFile("testdata/j_expect.proto")
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	if !bytes.Equal(actual, expect) {
+		t.Fatalf("expected:\n---\n%s\n--\nactual:\n---\n%s\n---\n", expect, actual)
+	}
+	if want := []string{"6:22", "7:21"}; !reflect.DeepEqual(rewritten, want) {
+		t.Fatalf("rewritten positions = %v, want %v", rewritten, want)
+	}
+}
+
+func TestRewriteText(t *testing.T) {
+	dir := t.TempDir()
+	input, err := os.ReadFile("testdata/k.txt")
+	if err != nil {
+		t.Fatalf("read input: %v", err)
+	}
+	for _, name := range []string{"README.txt", ".github/workflows/ci.yml", "testdata/skip.txt", "other.md"} {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, input, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = RewriteModule(dir, RewriteModuleOptions{
+		CommonOptions: CommonOptions{
+			Text: []string{"*.txt", ".github/workflows/*.yml"},
+		},
+		Prefix:     "github.com/foo/mod",
+		NewVersion: "v2.0.0",
+	})
+	if err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+	expect, err := os.ReadFile("testdata/k_expect.txt")
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	for name, want := range map[string][]byte{
+		"README.txt":               expect,
+		".github/workflows/ci.yml": expect,
+		"testdata/skip.txt":        input,
+		"other.md":                 input,
+	} {
+		actual, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(actual, want) {
+			t.Fatalf("%s: expected:\n---\n%s\n--\nactual:\n---\n%s\n---\n", name, want, actual)
+		}
+	}
+}
+
+func TestRewriteTestdata(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := os.ReadFile("testdata/l.txtar")
+	if err != nil {
+		t.Fatalf("read input: %v", err)
+	}
+	files := map[string]string{
+		"a.go":                  "package a\n\nimport _ \"github.com/foo/mod\"\n",
+		"testdata/golden.go":    "package golden\n\nimport _ \"github.com/foo/mod\"\n",
+		"testdata/broken.go":    "package broken\n\nimport _ \"github.com/foo/mod\"\n\nfunc {\n",
+		"testdata/fix/go.mod":   "module example.com/fix\n\nrequire (\n\tgithub.com/foo/mod v1.0.0\n)\n",
+		"testdata/script/l.txt": string(archive),
+	}
+	for name, data := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var rewritten []string
+	err = RewriteModule(dir, RewriteModuleOptions{
+		CommonOptions: CommonOptions{Testdata: true},
+		Prefix:        "github.com/foo/mod",
+		NewVersion:    "v2.0.0",
+		OnRewrite: func(pos token.Position, oldpath, newpath string) error {
+			rel, _ := filepath.Rel(dir, pos.Filename)
+			rewritten = append(rewritten, fmt.Sprintf("%s:%d:%d %s", filepath.ToSlash(rel), pos.Line, pos.Column, newpath))
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+	expect, err := os.ReadFile("testdata/l_expect.txtar")
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	for name, want := range map[string]string{
+		"a.go":                  "package a\n\nimport _ \"github.com/foo/mod/v2\"\n",
+		"testdata/golden.go":    "package golden\n\nimport _ \"github.com/foo/mod/v2\"\n",
+		"testdata/broken.go":    files["testdata/broken.go"],
+		"testdata/fix/go.mod":   "module example.com/fix\n\nrequire (\n\tgithub.com/foo/mod/v2 v2.0.0\n)\n",
+		"testdata/script/l.txt": string(expect),
+	} {
+		actual, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != want {
+			t.Fatalf("%s: expected:\n---\n%s\n--\nactual:\n---\n%s\n---\n", name, want, actual)
+		}
+	}
+	want := []string{
+		"a.go:3:8 github.com/foo/mod/v2",
+		"testdata/fix/go.mod:4:2 github.com/foo/mod/v2",
+		"testdata/golden.go:3:8 github.com/foo/mod/v2",
+		"testdata/script/l.txt:10:9 github.com/foo/mod/v2",
+		"testdata/script/l.txt:12:9 github.com/foo/mod/v2",
+		"testdata/script/l.txt:16:8 github.com/foo/mod/v2/pkg",
+	}
+	if !reflect.DeepEqual(rewritten, want) {
+		t.Fatalf("rewritten = %q, want %q", rewritten, want)
+	}
+}
+
+func TestRewriteTolerant(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.go": "package a\n\nimport \"github.com/foo/a\"\n",
+		"b.go": "package a\n\nimport \"github.com/foo/a\"\n\nfunc {\n",
+		"c.go": "package a\n\nimport \"github.com/foo/a\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := Rewrite(dir, RewriteOptions{
+		CommonOptions: CommonOptions{Tolerant: true},
+		Replace: func(pos token.Position, path string) (string, error) {
+			return "github.com/bar/a", nil
+		},
+	})
+	var perrs ParseErrors
+	if !errors.As(err, &perrs) {
+		t.Fatalf("expected parse errors, got %v", err)
+	}
+	var skipped []string
+	for _, e := range perrs {
+		skipped = append(skipped, fmt.Sprintf("%s:%d", filepath.Base(e.Pos.Filename), e.Pos.Line))
+	}
+	if want := []string{"b.go:5", "c.go:3"}; !reflect.DeepEqual(skipped, want) {
+		t.Fatalf("skipped = %v, want %v", skipped, want)
+	}
+	for name, expect := range map[string]string{
+		"a.go": "package a\n\nimport \"github.com/bar/a\"\n",
+		"b.go": "package a\n\nimport \"github.com/bar/a\"\n\nfunc {\n",
+		"c.go": files["c.go"],
+	} {
+		actual, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != expect {
+			t.Fatalf("%s: expected:\n%s\nactual:\n%s", name, expect, actual)
+		}
+	}
+}
+
+func TestRewriteFiles(t *testing.T) {
+	dir := t.TempDir()
+	src := "package a\n\nimport \"github.com/foo/a\"\n"
+	for _, name := range []string{"a/a.go", "a/a_test.go", "b/b.go"} {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := Rewrite(dir, RewriteOptions{
+		CommonOptions: CommonOptions{
+			Files: []string{
+				filepath.Join(dir, "a", "a.go"),
+				filepath.Join(dir, "a", "a_test.go"),
+				filepath.Join(t.TempDir(), "c.go"),
+			},
+		},
+		Replace: func(pos token.Position, path string) (string, error) {
+			return "github.com/bar/a", nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten := "package a\n\nimport \"github.com/bar/a\"\n"
+	for name, expect := range map[string]string{
+		"a/a.go":      rewritten,
+		"a/a_test.go": rewritten,
+		"b/b.go":      src,
+	} {
+		actual, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(actual) != expect {
+			t.Fatalf("%s: expected:\n%s\nactual:\n%s", name, expect, actual)
+		}
+	}
+}
+
+func BenchmarkRewrite(b *testing.B) {
+	dir := b.TempDir()
+	const n = 20000
+	for i := range n {
+		// one in ten files imports the rewritten module
+		imp := "fmt"
+		if i%10 == 0 {
+			imp = "github.com/foo/a"
+		}
+		name := filepath.Join(dir, fmt.Sprintf("p%03d", i/100), fmt.Sprintf("f%d.go", i))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			b.Fatal(err)
+		}
+		src := fmt.Sprintf("package p\n\nimport %q\n\nfunc F%d() { _ = a.X }\n", imp, i)
+		if err := os.WriteFile(name, []byte(src), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	// swap the paths so every iteration rewrites the same files
+	swap := map[string]string{
+		"github.com/foo/a": "github.com/bar/a",
+		"github.com/bar/a": "github.com/foo/a",
+	}
+	opt := RewriteOptions{
+		Match: func(path string) bool {
+			_, ok := swap[path]
+			return ok
+		},
+		Replace: func(pos token.Position, path string) (string, error) {
+			newpath, ok := swap[path]
+			if !ok {
+				return "", ErrSkip
+			}
+			return newpath, nil
+		},
+	}
+	for b.Loop() {
+		if err := Rewrite(dir, opt); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRewriteOrder(t *testing.T) {
+	dir := t.TempDir()
+	for i := range 100 {
+		src := fmt.Sprintf("package a\n\nimport \"github.com/foo/a%d\"\n", i)
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%03d.go", i)), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var paths []string
+	err := Rewrite(dir, RewriteOptions{
+		Match: func(path string) bool {
+			return strings.HasPrefix(path, "github.com/foo/")
+		},
+		Replace: func(pos token.Position, path string) (string, error) {
+			paths = append(paths, path)
+			return strings.Replace(path, "foo", "bar", 1), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, path := range paths {
+		if want := fmt.Sprintf("github.com/foo/a%d", i); path != want {
+			t.Fatalf("call %d: path = %s, want %s", i, path, want)
+		}
+	}
+	if len(paths) != 100 {
+		t.Fatalf("got %d calls, want 100", len(paths))
+	}
+}
+
+func TestAddImports(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		imports map[string]string
+		local   string
+		expect  string
+	}{
+		{
+			name:    "single import",
+			input:   "package p\n\nimport \"example.com/x\"\n",
+			imports: map[string]string{"context": ""},
+			expect:  "package p\n\nimport (\n\t\"context\"\n\n\t\"example.com/x\"\n)\n",
+		},
+		{
+			name:    "grouped",
+			input:   "package p\n\nimport (\n\t\"fmt\"\n\n\t\"example.com/x\"\n\n\t\"example.com/app/y\"\n)\n",
+			imports: map[string]string{"context": "", "example.com/lib": "", "example.com/app/z": "z2"},
+			local:   "example.com/app",
+			expect:  "package p\n\nimport (\n\t\"context\"\n\t\"fmt\"\n\n\t\"example.com/lib\"\n\t\"example.com/x\"\n\n\t\"example.com/app/y\"\n\tz2 \"example.com/app/z\"\n)\n",
+		},
+		{
+			name:    "ungrouped",
+			input:   "package p\n\nimport (\n\t\"fmt\"\n\t\"example.com/x\"\n\n\t\"os\"\n)\n",
+			imports: map[string]string{"context": "", "example.com/y": ""},
+			expect:  "package p\n\nimport (\n\t\"fmt\"\n\t\"example.com/x\"\n\t\"context\"\n\t\"example.com/y\"\n\n\t\"os\"\n)\n",
+		},
+		{
+			name:    "ungrouped new run",
+			input:   "package p\n\nimport (\n\t\"os\"\n\t\"fmt\"\n)\n",
+			imports: map[string]string{"example.com/x": ""},
+			expect:  "package p\n\nimport (\n\t\"os\"\n\t\"fmt\"\n\n\t\"example.com/x\"\n)\n",
+		},
+		{
+			name:    "no imports",
+			input:   "package p\n",
+			imports: map[string]string{"context": ""},
+			expect:  "package p\n\nimport (\n\t\"context\"\n)\n",
+		},
+		{
+			name:    "import comment",
+			input:   "package p // import \"example.com/p\"\n\nfunc F() {}\n",
+			imports: map[string]string{"context": ""},
+			expect:  "package p // import \"example.com/p\"\n\nimport (\n\t\"context\"\n)\n\nfunc F() {}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fset := token.NewFileSet()
+			f, err := parser.ParseFile(fset, "p.go", tt.input, parser.ImportsOnly|parser.ParseComments)
+			if err != nil {
+				t.Fatal(err)
+			}
+			src := []byte(tt.input)
+			start, end, text := AddImports(fset.File(f.Pos()), src, f, tt.imports, tt.local)
+			actual := string(src[:start]) + text + string(src[end:])
+			if actual != tt.expect {
+				t.Fatalf("expected:\n---\n%s\n---\nactual:\n---\n%s\n---\n", tt.expect, actual)
+			}
+		})
+	}
+}
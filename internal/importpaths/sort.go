@@ -0,0 +1,524 @@
+package importpaths
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/scanner"
+	"go/token"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// importEdits returns the edits required to change the import paths in the declaration
+// and remove the dropped specs. If the new paths leave a previously sorted and grouped
+// declaration out of order, the whole block is regrouped the way goimports does.
+// Otherwise, only the blank line separated runs are sorted.
+func importEdits(tf *token.File, src []byte, d *ast.GenDecl, paths map[*ast.ImportSpec]importRewrite, drop map[*ast.ImportSpec]bool, local string) []edit {
+	var edits []edit
+	var specs, all []*importSpec
+	for _, s := range d.Specs {
+		s := s.(*ast.ImportSpec)
+		spec := &importSpec{
+			spec:  s,
+			start: tf.Offset(s.Pos()),
+			end:   tf.Offset(s.End()),
+		}
+		spec.oldpath, _ = strconv.Unquote(s.Path.Value)
+		spec.path = spec.oldpath
+		if s.Doc != nil {
+			spec.start = tf.Offset(s.Doc.Pos())
+		}
+		if s.Comment != nil {
+			spec.end = tf.Offset(s.Comment.End())
+		}
+		all = append(all, spec)
+		if drop[s] {
+			edits = append(edits, deleteLines(src, spec.start, spec.end))
+			continue
+		}
+		if rw, ok := paths[s]; ok {
+			spec.path = rw.path
+			spec.name = rw.name
+			spec.changed = true
+			edits = append(edits, edit{
+				start: tf.Offset(s.Path.Pos()),
+				end:   tf.Offset(s.Path.End()),
+				text:  spec.pathText(),
+			})
+		}
+		spec.group = importGroup(local, spec.path)
+		spec.oldgroup = importGroup(local, spec.oldpath)
+		specs = append(specs, spec)
+	}
+	if len(specs) == 0 && len(all) > 0 {
+		start := tf.Offset(d.Pos())
+		if d.Doc != nil {
+			start = tf.Offset(d.Doc.Pos())
+		}
+		e := deleteLines(src, start, tf.Offset(d.End()))
+		// also remove the blank line separating it from the previous declaration
+		for _, nl := range []string{"\n\n", "\r\n\r\n"} {
+			if bytes.HasSuffix(src[:e.start], []byte(nl)) {
+				e.start -= len(nl) / 2
+				break
+			}
+		}
+		return []edit{e}
+	}
+	if len(edits) == 0 || !d.Lparen.IsValid() || importsSorted(tf, specs, false) {
+		return edits
+	}
+	var runs [][]*importSpec
+	if importsSorted(tf, specs, true) {
+		runs = groupRuns(specs)
+	} else {
+		runs = blankRuns(tf, specs)
+	}
+	block, ok := sortedBlock(tf, src, d, all, runs)
+	if !ok {
+		return edits
+	}
+	return []edit{block}
+}
+
+// importSpec is an import spec with its rewritten path.
+type importSpec struct {
+	spec       *ast.ImportSpec
+	path       string
+	name       string // added name
+	oldpath    string
+	group      int
+	oldgroup   int
+	changed    bool
+	added      bool // not in the source
+	start, end int  // includes comments
+}
+
+// deleteLines returns an edit which deletes the range [start, end) and
+// the rest of the lines it occupies if they are otherwise blank.
+func deleteLines(src []byte, start, end int) edit {
+	lineStart := bytes.LastIndexByte(src[:start], '\n') + 1
+	if len(bytes.TrimSpace(src[lineStart:start])) == 0 {
+		start = lineStart
+	}
+	if i := bytes.IndexByte(src[end:], '\n'); i >= 0 && len(bytes.TrimSpace(src[end:end+i])) == 0 {
+		end += i + 1
+	}
+	return edit{start: start, end: end}
+}
+
+// duplicateImports finds imports which have the same path after rewriting.
+// The returned specs can be dropped because an identical import remains.
+// Blank imports are dropped in favour of a named import of the same path.
+// If the duplicate imports have different names, the conflicts are returned.
+func duplicateImports(fset *token.FileSet, imports []*ast.ImportSpec, paths map[*ast.ImportSpec]importRewrite) (map[*ast.ImportSpec]bool, ImportConflicts) {
+	pathOf := func(s *ast.ImportSpec) string {
+		if rw, ok := paths[s]; ok {
+			return rw.path
+		}
+		path, _ := strconv.Unquote(s.Path.Value)
+		return path
+	}
+	nameOf := func(s *ast.ImportSpec) string {
+		if rw, ok := paths[s]; ok && rw.name != "" {
+			return rw.name
+		}
+		return importName(s)
+	}
+	drop := map[*ast.ImportSpec]bool{}
+	var conflicts ImportConflicts
+	for i, s := range imports {
+		if drop[s] {
+			continue
+		}
+		for _, other := range imports[i+1:] {
+			if drop[other] || pathOf(s) != pathOf(other) {
+				continue
+			}
+			// don't touch duplicates which weren't created by rewriting
+			_, schanged := paths[s]
+			_, ochanged := paths[other]
+			if !schanged && !ochanged {
+				continue
+			}
+			sname, oname := nameOf(s), nameOf(other)
+			switch {
+			case sname == oname && ochanged, oname == "_":
+				drop[other] = true
+			case sname == oname, sname == "_":
+				drop[s] = true
+			default:
+				conflicts = append(conflicts, &scanner.Error{
+					Pos: fset.PositionFor(s.Pos(), false),
+					Msg: fmt.Sprintf(
+						"import %q as %s conflicts with import as %s on line %d",
+						pathOf(s), displayName(sname), displayName(oname),
+						fset.PositionFor(other.Pos(), false).Line,
+					),
+				})
+			}
+			if drop[s] {
+				break
+			}
+		}
+	}
+	return drop, conflicts
+}
+
+// displayName returns a human readable import name.
+func displayName(name string) string {
+	if name == "" {
+		return "(default name)"
+	}
+	return name
+}
+
+// blankRuns splits the specs into blank line separated runs.
+func blankRuns(tf *token.File, specs []*importSpec) [][]*importSpec {
+	var runs [][]*importSpec
+	for i, s := range specs {
+		if i == 0 || tf.Line(tf.Pos(specs[i-1].end))+1 < tf.Line(tf.Pos(s.start)) {
+			runs = append(runs, nil)
+		}
+		runs[len(runs)-1] = append(runs[len(runs)-1], s)
+	}
+	return runs
+}
+
+// groupRuns splits the specs into runs by their group.
+func groupRuns(specs []*importSpec) [][]*importSpec {
+	sorted := append([]*importSpec(nil), specs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].group < sorted[j].group
+	})
+	var runs [][]*importSpec
+	for i, s := range sorted {
+		if i == 0 || sorted[i-1].group != s.group {
+			runs = append(runs, nil)
+		}
+		runs[len(runs)-1] = append(runs[len(runs)-1], s)
+	}
+	return runs
+}
+
+// text returns the source of the spec with the new path.
+func (s *importSpec) text(tf *token.File, src []byte) string {
+	if s.added {
+		return s.pathText()
+	}
+	text := src[s.start:s.end]
+	if !s.changed {
+		return string(text)
+	}
+	return string(applyEdits(text, []edit{{
+		start: tf.Offset(s.spec.Path.Pos()) - s.start,
+		end:   tf.Offset(s.spec.Path.End()) - s.start,
+		text:  s.pathText(),
+	}}))
+}
+
+// pathText returns the quoted path preceded by the added name.
+func (s *importSpec) pathText() string {
+	if s.name != "" {
+		return s.name + " " + strconv.Quote(s.path)
+	}
+	return strconv.Quote(s.path)
+}
+
+// importRewrite is the new path of an import spec.
+// If name is not empty, it's added as the spec's name.
+type importRewrite struct {
+	path string
+	name string
+}
+
+// importsSorted reports whether the specs are sorted and grouped.
+// Each blank line separated run must be sorted by path and only
+// contain a single group, and the groups must be in increasing order.
+// If old is true, the paths before rewriting are checked.
+func importsSorted(tf *token.File, specs []*importSpec, old bool) bool {
+	key := func(s *importSpec) (string, int) {
+		if old {
+			return s.oldpath, s.oldgroup
+		}
+		return s.path, s.group
+	}
+	for i := 1; i < len(specs); i++ {
+		prevpath, prevgroup := key(specs[i-1])
+		path, group := key(specs[i])
+		prevline := tf.Line(tf.Pos(specs[i-1].end))
+		line := tf.Line(tf.Pos(specs[i].start))
+		if prevline == line {
+			return false
+		}
+		if prevline+1 < line {
+			// new run
+			if prevgroup >= group {
+				return false
+			}
+			continue
+		}
+		if prevgroup != group || prevpath > path {
+			return false
+		}
+	}
+	return true
+}
+
+// sortedBlock returns an edit which replaces the contents of the parenthesized
+// import declaration with the sorted runs separated by blank lines.
+// It returns false if the block contains comments which don't belong to a spec,
+// or if multiple specs share a line.
+func sortedBlock(tf *token.File, src []byte, d *ast.GenDecl, specs []*importSpec, runs [][]*importSpec) (edit, bool) {
+	start := tf.Offset(d.Lparen) + 1
+	end := tf.Offset(d.Rparen)
+	// make sure the specs account for everything in the block
+	var nonspace int
+	for _, s := range specs {
+		nonspace += len(bytes.Join(bytes.Fields(src[s.start:s.end]), nil))
+	}
+	if len(bytes.Join(bytes.Fields(src[start:end]), nil)) != nonspace {
+		return edit{}, false
+	}
+	for i := 1; i < len(specs); i++ {
+		if tf.Line(tf.Pos(specs[i-1].end)) == tf.Line(tf.Pos(specs[i].start)) {
+			return edit{}, false
+		}
+	}
+	// preserve the line endings and indentation
+	newline := "\n"
+	if bytes.Contains(src[start:end], []byte("\r\n")) {
+		newline = "\r\n"
+	}
+	indent := "\t"
+	if len(specs) > 0 {
+		first := specs[0].start
+		lineStart := bytes.LastIndexByte(src[:first], '\n') + 1
+		if ws := string(src[lineStart:first]); strings.TrimSpace(ws) == "" {
+			indent = ws
+		}
+	}
+	var b strings.Builder
+	b.WriteString(newline)
+	writeRuns(&b, tf, src, runs, indent, newline)
+	return edit{start: start, end: end, text: b.String()}, true
+}
+
+// writeRuns writes the specs of each run sorted by path, separating the runs with blank lines.
+func writeRuns(b *strings.Builder, tf *token.File, src []byte, runs [][]*importSpec, indent, newline string) {
+	for i, run := range runs {
+		if i > 0 {
+			b.WriteString(newline)
+		}
+		run = append([]*importSpec(nil), run...)
+		sort.SliceStable(run, func(i, j int) bool {
+			if run[i].path != run[j].path {
+				return run[i].path < run[j].path
+			}
+			return run[i].importName() < run[j].importName()
+		})
+		for _, s := range run {
+			b.WriteString(indent)
+			b.WriteString(s.text(tf, src))
+			b.WriteString(newline)
+		}
+	}
+}
+
+// importName returns the explicit name of the import or an empty string.
+func (s *importSpec) importName() string {
+	if s.name != "" || s.added {
+		return s.name
+	}
+	return importName(s.spec)
+}
+
+// importName returns the explicit name of the import or an empty string.
+func importName(s *ast.ImportSpec) string {
+	if s.Name == nil {
+		return ""
+	}
+	return s.Name.Name
+}
+
+// importGroup returns the goimports group of the import path.
+// Standard library imports are in group 0, third-party imports
+// are in group 1, and imports matching the local prefix are in group 2.
+func importGroup(local, path string) int {
+	for _, prefix := range strings.Split(local, ",") {
+		if prefix == "" {
+			continue
+		}
+		if strings.HasPrefix(path, prefix) || strings.TrimSuffix(prefix, "/") == path {
+			return 2
+		}
+	}
+	first, _, _ := strings.Cut(path, "/")
+	if strings.Contains(first, ".") {
+		return 1
+	}
+	return 0
+}
+
+// AddImports returns the edit which adds the imports to the first import declaration
+// of the file. The imports map paths to names, which are empty for the default name.
+// If the declaration is sorted and grouped, the new imports are grouped the way
+// goimports does, using the local prefix like CommonOptions.LocalPrefix.
+// Otherwise, they're added to the end of the first blank line separated run of
+// their group, and the existing specs are left as they are.
+// The text replaces the range [start, end) of src.
+func AddImports(tf *token.File, src []byte, f *ast.File, imports map[string]string, local string) (start, end int, text string) {
+	var added []*importSpec
+	for path, name := range imports {
+		added = append(added, &importSpec{
+			path:    path,
+			oldpath: path,
+			name:    name,
+			added:   true,
+			group:   importGroup(local, path),
+		})
+	}
+	sort.Slice(added, func(i, j int) bool {
+		return added[i].path < added[j].path
+	})
+	var d *ast.GenDecl
+	for _, decl := range f.Decls {
+		if decl, ok := decl.(*ast.GenDecl); ok && decl.Tok == token.IMPORT {
+			d = decl
+			break
+		}
+	}
+	var b strings.Builder
+	if d == nil {
+		// add a declaration after the package clause
+		b.WriteString("\n\nimport (\n")
+		writeRuns(&b, tf, src, groupRuns(added), "\t", "\n")
+		b.WriteString(")")
+		off := packageClauseEnd(tf, f)
+		return off, off, b.String()
+	}
+	var specs []*importSpec
+	for _, s := range d.Specs {
+		s := s.(*ast.ImportSpec)
+		spec := &importSpec{
+			spec:  s,
+			start: tf.Offset(s.Pos()),
+			end:   tf.Offset(s.End()),
+		}
+		spec.path, _ = strconv.Unquote(s.Path.Value)
+		spec.oldpath = spec.path
+		if s.Doc != nil {
+			spec.start = tf.Offset(s.Doc.Pos())
+		}
+		if s.Comment != nil {
+			spec.end = tf.Offset(s.Comment.End())
+		}
+		spec.group = importGroup(local, spec.path)
+		spec.oldgroup = spec.group
+		specs = append(specs, spec)
+	}
+	if !d.Lparen.IsValid() {
+		// turn the single import into a block
+		b.WriteString("import (\n")
+		writeRuns(&b, tf, src, groupRuns(append(specs, added...)), "\t", "\n")
+		b.WriteString(")")
+		return tf.Offset(d.Pos()), tf.Offset(d.End()), b.String()
+	}
+	if !importsSorted(tf, specs, false) {
+		e := insertImports(tf, src, d, specs, added)
+		return e.start, e.end, e.text
+	}
+	runs := groupRuns(append(specs, added...))
+	if e, ok := sortedBlock(tf, src, d, specs, runs); ok {
+		return e.start, e.end, e.text
+	}
+	// the block has comments which don't belong to a spec
+	for _, a := range added {
+		b.WriteString("\t" + a.pathText() + "\n")
+	}
+	off := tf.Offset(d.Rparen)
+	return off, off, b.String()
+}
+
+// packageClauseEnd returns the offset after the package clause,
+// including the comments which follow it on the same line.
+func packageClauseEnd(tf *token.File, f *ast.File) int {
+	end := f.Name.End()
+	line := tf.Line(f.Package)
+	for _, g := range f.Comments {
+		for _, c := range g.List {
+			if c.Pos() >= end && tf.Line(c.Pos()) == line {
+				end = c.End()
+			}
+		}
+	}
+	return tf.Offset(end)
+}
+
+// insertImports returns the edit which inserts the added specs into an unsorted
+// import block without moving the existing specs. Each spec is added to the end
+// of the first blank line separated run of its group, and the specs without a
+// matching run are grouped into new runs at the end of the block.
+func insertImports(tf *token.File, src []byte, d *ast.GenDecl, specs, added []*importSpec) edit {
+	lparen, rparen := tf.Offset(d.Lparen), tf.Offset(d.Rparen)
+	newline := "\n"
+	if bytes.Contains(src[lparen:rparen], []byte("\r\n")) {
+		newline = "\r\n"
+	}
+	indentOf := func(off int) string {
+		lineStart := bytes.LastIndexByte(src[:off], '\n') + 1
+		if ws := string(src[lineStart:off]); strings.TrimSpace(ws) == "" {
+			return ws
+		}
+		return "\t"
+	}
+	var edits []edit
+	var rest []*importSpec
+	runs := blankRuns(tf, specs)
+next:
+	for _, a := range added {
+		for _, run := range runs {
+			if !slices.ContainsFunc(run, func(s *importSpec) bool { return s.group == a.group }) {
+				continue
+			}
+			last := run[len(run)-1]
+			text := indentOf(last.start) + a.pathText() + newline
+			off := last.end + bytes.IndexByte(src[last.end:], '\n') + 1
+			if off > rparen {
+				// the closing paren is on the same line
+				off, text = rparen, newline+text
+			}
+			edits = append(edits, edit{start: off, end: off, text: text})
+			continue next
+		}
+		rest = append(rest, a)
+	}
+	if len(rest) > 0 {
+		indent := "\t"
+		if len(specs) > 0 {
+			indent = indentOf(specs[0].start)
+		}
+		var b strings.Builder
+		b.WriteString(newline)
+		off := bytes.LastIndexByte(src[:rparen], '\n') + 1
+		if strings.TrimSpace(string(src[off:rparen])) != "" || off <= lparen {
+			off = rparen
+			b.WriteString(newline)
+		}
+		writeRuns(&b, tf, src, groupRuns(rest), indent, newline)
+		edits = append(edits, edit{start: off, end: off, text: b.String()})
+	}
+	// combine the insertions into a single edit
+	start, end := rparen, lparen
+	for _, e := range edits {
+		start, end = min(start, e.start), max(end, e.end)
+	}
+	for i := range edits {
+		edits[i].start -= start
+		edits[i].end -= start
+	}
+	return edit{start: start, end: end, text: string(applyEdits(src[start:end], edits))}
+}
@@ -0,0 +1,212 @@
+package importpaths
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"log"
+	"path"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/tools/txtar"
+)
+
+// isTxtar reports whether the named file is a txtar archive.
+// Testscript archives often use the .txt extension.
+func isTxtar(name string) bool {
+	return strings.HasSuffix(name, ".txtar") || strings.HasSuffix(name, ".txt")
+}
+
+// rewriteFixture is like rewriteFile, but Go files which don't parse are skipped
+// because test fixtures are often invalid on purpose.
+func rewriteFixture(name string, src []byte, opt RewriteOptions) ([]byte, bool, error) {
+	data, ok, err := rewriteFile(name, src, opt)
+	var list scanner.ErrorList
+	if errors.As(err, &list) {
+		log.Println("import rewrite: skipping", err)
+		return nil, false, nil
+	}
+	return data, ok, err
+}
+
+// rewriteTxtar returns the rewritten contents of the txtar archive src.
+// The embedded .go and go.mod files are rewritten, and positions are
+// reported relative to the archive. Only the changed files are modified,
+// the rest of the archive is left byte-for-byte identical.
+func rewriteTxtar(name string, src []byte, opt RewriteOptions) ([]byte, bool, error) {
+	ar := txtar.Parse(src)
+	var edits []edit
+	offset := len(ar.Comment)
+	for _, f := range ar.Files {
+		start, ok := txtarFileStart(src, offset, f.Name)
+		if !ok {
+			return nil, false, fmt.Errorf("%s: cannot find %s", name, f.Name)
+		}
+		// txtar.Parse adds a missing trailing newline to the last file
+		end := min(start+len(f.Data), len(src))
+		offset = end
+		var rewrite rewriteFunc
+		switch {
+		case strings.HasSuffix(f.Name, ".go"):
+			rewrite = rewriteFixture
+		case path.Base(f.Name) == "go.mod":
+			rewrite = rewriteGoMod
+		default:
+			continue
+		}
+		fopt := opt
+		fopt.Replace = func(pos token.Position, p string) (string, error) {
+			base := offsetPosition(name, src, start)
+			pos.Filename = name
+			pos.Offset += start
+			pos.Line += base.Line - 1
+			return opt.Replace(pos, p)
+		}
+		data, ok, err := rewrite(f.Name, src[start:end], fopt)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			edits = append(edits, edit{start: start, end: end, text: string(data)})
+		}
+	}
+	if len(edits) == 0 {
+		return nil, false, nil
+	}
+	return applyEdits(src, edits), true, nil
+}
+
+// txtarFileStart returns the offset of the data of the named txtar file
+// by finding its marker line at or after offset.
+func txtarFileStart(src []byte, offset int, name string) (int, bool) {
+	for offset < len(src) {
+		line := src[offset:]
+		next := len(src)
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+			next = offset + i + 1
+		}
+		marker := bytes.TrimSpace(line)
+		if bytes.HasPrefix(marker, []byte("-- ")) && bytes.HasSuffix(marker, []byte(" --")) &&
+			string(bytes.TrimSpace(marker[3:len(marker)-3])) == name {
+			return next, true
+		}
+		offset = next
+	}
+	return 0, false
+}
+
+// rewriteGoMod returns the rewritten contents of the go.mod src.
+// The module paths in the module, require, and replace directives are passed
+// to opt.Replace. The versions of rewritten paths are passed to opt.Pin, and
+// if the result isn't valid for the new path, the first version of the new
+// path's major version is used.
+func rewriteGoMod(name string, src []byte, opt RewriteOptions) ([]byte, bool, error) {
+	file, err := modfile.Parse(name, src, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	var edits []edit
+	// rewrite replaces the path token at index i, and the version token at index v if it's positive.
+	rewrite := func(line *modfile.Line, i, v int) error {
+		if line.InBlock {
+			i--
+			v--
+		}
+		offsets := tokenOffsets(src, line)
+		if i >= len(offsets) || v >= len(offsets) {
+			return nil
+		}
+		oldpath := line.Token[i]
+		if !isPackagePath(oldpath) {
+			return nil
+		}
+		pos := offsetPosition(name, src, offsets[i])
+		newpath, err := opt.Replace(pos, oldpath)
+		if err != nil {
+			if err == ErrSkip {
+				return nil
+			}
+			return fmt.Errorf("%s: %w", pos, err)
+		}
+		edits = append(edits, edit{start: offsets[i], end: offsets[i] + len(oldpath), text: newpath})
+		if v > i {
+			version := line.Token[v]
+			edits = append(edits, edit{
+				start: offsets[v],
+				end:   offsets[v] + len(version),
+				text:  modVersion(opt, newpath, version),
+			})
+		}
+		return nil
+	}
+	if file.Module != nil {
+		if err := rewrite(file.Module.Syntax, 1, 0); err != nil {
+			return nil, false, err
+		}
+	}
+	for _, r := range file.Require {
+		if err := rewrite(r.Syntax, 1, 2); err != nil {
+			return nil, false, err
+		}
+	}
+	for _, r := range file.Replace {
+		// replace old [version] => new [version]
+		arrow := 2
+		if r.Old.Version != "" {
+			arrow = 3
+			if err := rewrite(r.Syntax, 1, 2); err != nil {
+				return nil, false, err
+			}
+		} else if err := rewrite(r.Syntax, 1, 0); err != nil {
+			return nil, false, err
+		}
+		if r.New.Version != "" {
+			if err := rewrite(r.Syntax, arrow+1, arrow+2); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	if len(edits) == 0 {
+		return nil, false, nil
+	}
+	return applyEdits(src, edits), true, nil
+}
+
+// tokenOffsets returns the offsets of the tokens in the go.mod line.
+func tokenOffsets(src []byte, line *modfile.Line) []int {
+	var offsets []int
+	i := line.Start.Byte
+	for i < line.End.Byte && len(offsets) < len(line.Token) {
+		if src[i] == ' ' || src[i] == '\t' {
+			i++
+			continue
+		}
+		offsets = append(offsets, i)
+		i += len(line.Token[len(offsets)-1])
+	}
+	return offsets
+}
+
+// modVersion returns the required version of a rewritten module path.
+// The version is passed to opt.Pin, and if the result isn't valid for the
+// path, the first version of the path's major version is used.
+func modVersion(opt RewriteOptions, path, version string) string {
+	if opt.Pin != nil {
+		version = opt.Pin(path, version)
+	}
+	if semver.IsValid(version) && module.Check(path, version) == nil {
+		return version
+	}
+	_, major, _ := module.SplitPathVersion(path)
+	major = strings.TrimLeft(major, "/.")
+	if major == "" {
+		return "v0.0.0"
+	}
+	return major + ".0.0"
+}
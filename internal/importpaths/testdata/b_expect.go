@@ -0,0 +1,12 @@
+package b // import "github.com/foo/b"
+
+import (
+    "fmt"
+
+  foo    "github.com/bar/a"   // the a package
+	"github.com/fix/b"
+)
+
+func main()  {
+	fmt.Println( foo.A,b.B )
+}
@@ -0,0 +1,7 @@
+﻿package c // import "github.com/foo/c"
+
+import (
+	"github.com/foo/a"
+)
+
+var _ = a.A
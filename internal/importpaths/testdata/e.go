@@ -0,0 +1,11 @@
+package e
+
+import (
+	"fmt"
+
+	"github.com/foo/a" // comment a
+	// doc for b
+	"github.com/foo/b"
+
+	"example.com/local/x"
+)
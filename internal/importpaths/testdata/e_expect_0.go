@@ -0,0 +1,11 @@
+package e
+
+import (
+	"fmt"
+
+	// doc for b
+	"github.com/foo/b"
+	"github.com/zoo/a" // comment a
+
+	"example.com/local/x"
+)
@@ -0,0 +1,11 @@
+package e
+
+import (
+	"fmt"
+
+	"github.com/foo/a" // comment a
+
+	// doc for b
+	"example.com/local/b"
+	"example.com/local/x"
+)
@@ -0,0 +1,10 @@
+package f
+
+import (
+	"fmt"
+
+	"github.com/foo/redis/v8"
+	"github.com/foo/redis/v9"
+)
+
+import _ "github.com/foo/redis/v8"
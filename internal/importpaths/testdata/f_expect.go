@@ -0,0 +1,7 @@
+package f
+
+import (
+	"fmt"
+
+	"github.com/foo/redis/v9"
+)
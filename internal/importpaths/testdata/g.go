@@ -0,0 +1,6 @@
+package g
+
+import (
+	redisv8 "github.com/foo/redis/v8"
+	"github.com/foo/redis/v9"
+)
@@ -0,0 +1,7 @@
+package h
+
+import (
+	"fmt"
+
+	"github.com/foo/yaml"
+)
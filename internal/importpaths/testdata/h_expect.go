@@ -0,0 +1,7 @@
+package h
+
+import (
+	"fmt"
+
+	yaml "github.com/foo/yaml/v3"
+)
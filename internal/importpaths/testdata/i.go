@@ -0,0 +1,12 @@
+package main
+
+import "github.com/foo/gen/pkg"
+
+//go:generate go run github.com/foo/gen@v1.2.0 -out "github.com/foo/gen" pkg.go
+//go:generate go run github.com/foo/gen/cmd/x
+//go:generate	github.com/foo/gen/cmd/y@latest
+//go:generate go run github.com/foo/generate/cmd/z@v1.0.0
+// go:generate go run github.com/foo/gen
+	//go:generate go run github.com/foo/gen
+
+var _ = pkg.X
@@ -0,0 +1,12 @@
+package main
+
+import "github.com/foo/gen/v2/pkg"
+
+//go:generate go run github.com/foo/gen/v2@v2.0.0 -out "github.com/foo/gen" pkg.go
+//go:generate go run github.com/foo/gen/v2/cmd/x
+//go:generate	github.com/foo/gen/v2/cmd/y@latest
+//go:generate go run github.com/foo/generate/cmd/z@v1.0.0
+// go:generate go run github.com/foo/gen
+	//go:generate go run github.com/foo/gen
+
+var _ = pkg.X
@@ -0,0 +1,119 @@
+package importpaths
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/icholy/gomajor/internal/packages"
+)
+
+// rewriteText returns the rewritten contents of a non-Go src.
+// The second return value is false if nothing was changed.
+// Every whole token which looks like a package path is passed to opt.Replace.
+// Tokens are runs of package path characters, and ones which are part of a
+// URL or another path (preceded by a slash) are skipped. Trailing dots are
+// treated as punctuation. Like go:generate directives, an @version pin
+// following a rewritten path is passed to opt.Pin.
+func rewriteText(name string, src []byte, opt RewriteOptions) ([]byte, bool, error) {
+	var edits []edit
+	text := string(src)
+	for i := 0; i < len(text); {
+		if !isPathChar(text[i]) {
+			i++
+			continue
+		}
+		start := i
+		for i < len(text) && isPathChar(text[i]) {
+			i++
+		}
+		end := i
+		for end > start && text[end-1] == '.' {
+			end--
+		}
+		word := text[start:end]
+		if !isPackagePath(word) {
+			continue
+		}
+		pos := offsetPosition(name, src, start)
+		newpath, err := opt.Replace(pos, word)
+		if err != nil {
+			if err == ErrSkip {
+				continue
+			}
+			return nil, false, fmt.Errorf("%s: %w", pos, err)
+		}
+		e := edit{start: start, end: end, text: newpath}
+		if end == i && i < len(text) && text[i] == '@' {
+			vend := i + 1
+			for vend < len(text) && isVersionChar(text[vend]) {
+				vend++
+			}
+			for vend > i+1 && text[vend-1] == '.' {
+				vend--
+			}
+			if version := text[i+1 : vend]; version != "" && opt.Pin != nil {
+				e.end = vend
+				e.text += "@" + opt.Pin(newpath, version)
+				i = vend
+			}
+		}
+		edits = append(edits, e)
+	}
+	if len(edits) == 0 {
+		return nil, false, nil
+	}
+	return applyEdits(src, edits), true, nil
+}
+
+// isPathChar reports whether c can be part of a package path.
+func isPathChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '.' || c == '-' || c == '_' || c == '~' || c == '/'
+}
+
+// isVersionChar reports whether c can be part of a version query.
+func isVersionChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '.' || c == '-' || c == '+'
+}
+
+// textFiles returns the non-Go files in dir which match the glob patterns.
+// Patterns without a slash are matched against the file name, and the others are
+// matched against the slash-separated path relative to dir. Unlike Go files,
+// files in dot-prefix and underscore-prefix directories are included so CI configuration
+// can be matched. The other directories skipped by packages.WalkModule are skipped.
+func textFiles(dir string, patterns []string) ([]string, error) {
+	var names []string
+	err := packages.WalkModule(dir, packages.WalkOptions{Hidden: true}, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(name, ".go") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		for _, pattern := range patterns {
+			target := rel
+			if !strings.Contains(pattern, "/") {
+				target = path.Base(rel)
+			}
+			ok, err := path.Match(pattern, target)
+			if err != nil {
+				return fmt.Errorf("text pattern %q: %w", pattern, err)
+			}
+			if ok {
+				names = append(names, name)
+				break
+			}
+		}
+		return nil
+	})
+	return names, err
+}
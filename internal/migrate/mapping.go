@@ -0,0 +1,303 @@
+// Package migrate applies the source changes which a new version of a module requires.
+package migrate
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/icholy/gomajor/internal/importpaths"
+	"github.com/icholy/gomajor/internal/packages"
+	"github.com/icholy/gomajor/internal/refactor"
+	"github.com/icholy/gomajor/internal/usage"
+)
+
+// Mapping contains the renames needed to migrate to a new version of a module.
+//
+// The mapping file format has one rule per line, and lines starting with # are comments:
+//
+//	module github.com/redis/go-redis/v9
+//	package internal/pool -> pool
+//	redis.Client.Do -> Client.Execute
+//	Nil -> ErrNil
+//
+// The optional module line limits the mapping to a module path, ignoring the major version.
+// Package rules move imports from one package directory of the module to another.
+// Symbol rules rename references to an identifier, which may be qualified by
+// its package name, or the name it's imported as, and the type name for methods and fields.
+// Only the last element of the new name is used.
+type Mapping struct {
+	// Module is the module path the mapping applies to.
+	// If it's empty, the mapping applies to every module.
+	Module string
+	// Packages maps old package directories to new ones.
+	// The module root directory is ".".
+	Packages map[string]string
+	// Symbols maps [pkgname.]Name[.Member] to a new name.
+	Symbols map[string]string
+}
+
+// ReadMapping reads and parses the mapping file.
+func ReadMapping(name string) (*Mapping, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMapping(name, data)
+}
+
+// ParseMapping parses the mapping file data.
+func ParseMapping(name string, data []byte) (*Mapping, error) {
+	m := &Mapping{
+		Packages: map[string]string{},
+		Symbols:  map[string]string{},
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if modpath, ok := strings.CutPrefix(line, "module "); ok {
+			m.Module = strings.TrimSpace(modpath)
+			continue
+		}
+		left, right, ok := strings.Cut(line, "->")
+		left, right = strings.TrimSpace(left), strings.TrimSpace(right)
+		if !ok || left == "" || right == "" {
+			return nil, fmt.Errorf("%s:%d: expected old -> new", name, lineno)
+		}
+		if oldpkg, ok := strings.CutPrefix(left, "package "); ok {
+			oldpkg = path.Clean(strings.TrimSpace(oldpkg))
+			newpkg := path.Clean(strings.TrimSpace(strings.TrimPrefix(right, "package ")))
+			if path.IsAbs(oldpkg) || path.IsAbs(newpkg) {
+				return nil, fmt.Errorf("%s:%d: package directories must be relative to the module root", name, lineno)
+			}
+			m.Packages[oldpkg] = newpkg
+			continue
+		}
+		if !isQualifiedIdent(left, 3) || !isQualifiedIdent(right, 3) {
+			return nil, fmt.Errorf("%s:%d: invalid rename %q", name, lineno, line)
+		}
+		m.Symbols[left] = right[strings.LastIndexByte(right, '.')+1:]
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// isQualifiedIdent reports whether s is a dot-separated list of at most n identifiers.
+func isQualifiedIdent(s string, n int) bool {
+	elems := strings.Split(s, ".")
+	if len(elems) > n {
+		return false
+	}
+	for _, elem := range elems {
+		if !token.IsIdentifier(elem) {
+			return false
+		}
+	}
+	return true
+}
+
+// Applies reports whether the mapping applies to the module path.
+func (m *Mapping) Applies(modpath string) bool {
+	return m.Module == "" || packages.ModPrefix(m.Module) == packages.ModPrefix(modpath)
+}
+
+// RemapOptions specifies how to apply a mapping.
+type RemapOptions struct {
+	// ModPath is the new module path, which the imports were already rewritten to.
+	ModPath string
+	Mapping *Mapping
+	// Files limits the changes to the named Go files if it isn't nil.
+	Files []string
+	// OldPkgNames and NewPkgNames map the import paths of the packages in the
+	// old and new versions of the module to their declared names, like
+	// importpaths.RewriteModuleOptions. Moved imports are named after the old
+	// package so the references still resolve. Missing names are guessed.
+	OldPkgNames map[string]string
+	NewPkgNames map[string]string
+	// OnRewrite is called with every moved import.
+	OnRewrite func(pos token.Position, oldpath, newpath string)
+	// OnRename is called with every renamed identifier.
+	OnRename func(pos token.Position, oldname, newname string)
+	// OnTypeError is called with the files of the packages which don't type-check,
+	// and the first error of the package. Their renames may be incomplete.
+	OnTypeError func(name string, err error)
+}
+
+// pkgName returns the declared name of the package in the new module path.
+// Packages which don't exist in the new version are looked up in the old versions
+// by their directory, and the name is guessed if it's unknown.
+func (opt RemapOptions) pkgName(pkgpath string) string {
+	if name, ok := opt.NewPkgNames[pkgpath]; ok {
+		return name
+	}
+	matcher := importpaths.ModuleMatcher{Prefix: packages.ModPrefix(opt.ModPath)}
+	_, pkgdir, _ := matcher.Match(pkgpath)
+	var found string
+	for path := range opt.OldPkgNames {
+		// prefer the highest major version, which sorts last
+		if _, dir, ok := matcher.Match(path); ok && dir == pkgdir && path > found {
+			found = path
+		}
+	}
+	if found != "" {
+		return opt.OldPkgNames[found]
+	}
+	return packages.GuessName(pkgpath)
+}
+
+// Remap applies the mapping to the code in dir. The imports of moved packages
+// are rewritten first, and then the code is type-checked and the references to the
+// module's identifiers are renamed. References to identifiers which no longer
+// exist are found through the type of the selected expression or the package name.
+func Remap(dir string, opt RemapOptions) error {
+	m := opt.Mapping
+	if len(m.Packages) > 0 {
+		matcher := importpaths.ModuleMatcher{Prefix: packages.ModPrefix(opt.ModPath)}
+		err := importpaths.Rewrite(dir, importpaths.RewriteOptions{
+			CommonOptions: importpaths.CommonOptions{Files: opt.Files},
+			// keep the old package name so the references still resolve
+			Alias: func(oldpath, newpath string) string {
+				if oldname := opt.pkgName(oldpath); oldname != opt.pkgName(newpath) {
+					return oldname
+				}
+				return ""
+			},
+			Match: func(path string) bool {
+				modpath, _, ok := matcher.Match(path)
+				return ok && modpath == opt.ModPath
+			},
+			Replace: func(pos token.Position, path string) (string, error) {
+				modpath, pkgdir, ok := matcher.Match(path)
+				if !ok || modpath != opt.ModPath {
+					return "", importpaths.ErrSkip
+				}
+				if pkgdir == "" {
+					pkgdir = "."
+				}
+				newdir, ok := m.Packages[pkgdir]
+				if !ok {
+					return "", importpaths.ErrSkip
+				}
+				newpath := opt.ModPath
+				if newdir != "." {
+					newpath += "/" + newdir
+				}
+				if opt.OnRewrite != nil {
+					opt.OnRewrite(pos, path, newpath)
+				}
+				return newpath, nil
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(m.Symbols) == 0 {
+		return nil
+	}
+	pkgs, err := refactor.Load(dir, "./...")
+	if err != nil {
+		return err
+	}
+	r := renamer{
+		mapping: m,
+		finder:  usage.NewFinder(usage.Options{ModPath: opt.ModPath, Exact: true}),
+	}
+	scope, err := importpaths.FileSet(opt.Files)
+	if err != nil {
+		return err
+	}
+	reported := map[string]bool{}
+	for _, pkg := range pkgs {
+		for _, f := range pkg.Syntax {
+			name := pkg.Fset.PositionFor(f.Pos(), false).Filename
+			if scope != nil && !scope[name] {
+				continue
+			}
+			if len(pkg.Errors) > 0 && opt.OnTypeError != nil && !reported[name] {
+				reported[name] = true
+				opt.OnTypeError(name, pkg.Errors[0])
+			}
+			r.file(pkg.Fset, pkg.TypesInfo, f)
+		}
+	}
+	return r.ed.Write(opt.OnRename)
+}
+
+// renamer finds the references to renamed identifiers.
+type renamer struct {
+	mapping *Mapping
+	finder  *usage.Finder
+	ed      refactor.Editor
+}
+
+// file records the renames in the file.
+func (r *renamer) file(fset *token.FileSet, info *types.Info, f *ast.File) {
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Ident:
+			obj := info.Uses[n]
+			if obj == nil || obj.Pkg() == nil || !obj.Exported() || !r.finder.Match(obj.Pkg().Path()) {
+				return true
+			}
+			if _, ok := obj.(*types.PkgName); ok {
+				return true
+			}
+			r.rename(fset, n, r.finder.Name(obj), obj.Pkg().Name())
+		case *ast.SelectorExpr:
+			// selected identifiers which don't exist in the new version
+			if info.Uses[n.Sel] != nil {
+				return true
+			}
+			if x, ok := n.X.(*ast.Ident); ok {
+				if pkgname, ok := info.Uses[x].(*types.PkgName); ok {
+					if r.finder.Match(pkgname.Imported().Path()) {
+						r.rename(fset, n.Sel, n.Sel.Name, pkgname.Imported().Name(), pkgname.Name())
+					}
+					return true
+				}
+			}
+			tv, ok := info.Types[n.X]
+			if !ok {
+				return true
+			}
+			t := tv.Type
+			if ptr, ok := t.(*types.Pointer); ok {
+				t = ptr.Elem()
+			}
+			named, ok := types.Unalias(t).(*types.Named)
+			if !ok || named.Obj().Pkg() == nil || !r.finder.Match(named.Obj().Pkg().Path()) {
+				return true
+			}
+			r.rename(fset, n.Sel, named.Obj().Name()+"."+n.Sel.Name, named.Obj().Pkg().Name())
+		}
+		return true
+	})
+}
+
+// rename records a rename of the identifier if there's a rule for the name,
+// qualified by one of the package names or unqualified.
+func (r *renamer) rename(fset *token.FileSet, id *ast.Ident, name string, pkgnames ...string) {
+	for _, pkgname := range pkgnames {
+		if newname, ok := r.mapping.Symbols[pkgname+"."+name]; ok {
+			if newname != id.Name {
+				r.ed.Replace(fset, id, newname)
+			}
+			return
+		}
+	}
+	if newname, ok := r.mapping.Symbols[name]; ok && newname != id.Name {
+		r.ed.Replace(fset, id, newname)
+	}
+}
@@ -0,0 +1,102 @@
+package migrate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		mapping *Mapping
+		err     string
+	}{
+		{
+			name: "rules",
+			data: `# redis v9
+module github.com/redis/go-redis/v9
+
+package internal/pool -> package pool
+package . -> redis
+redis.Client.Do -> redis.Client.Execute
+Nil->ErrNil
+`,
+			mapping: &Mapping{
+				Module:   "github.com/redis/go-redis/v9",
+				Packages: map[string]string{"internal/pool": "pool", ".": "redis"},
+				Symbols:  map[string]string{"redis.Client.Do": "Execute", "Nil": "ErrNil"},
+			},
+		},
+		{
+			name: "missing arrow",
+			data: "Foo Bar\n",
+			err:  "migrate.txt:1: expected old -> new",
+		},
+		{
+			name: "invalid identifier",
+			data: "\nredis.Client.Do.X -> Execute\n",
+			err:  `migrate.txt:2: invalid rename "redis.Client.Do.X -> Execute"`,
+		},
+		{
+			name: "absolute package",
+			data: "package /pool -> pool\n",
+			err:  "migrate.txt:1: package directories must be relative to the module root",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := ParseMapping("migrate.txt", []byte(tt.data))
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("error = %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(m, tt.mapping) {
+				t.Fatalf("mapping = %+v, want %+v", m, tt.mapping)
+			}
+		})
+	}
+}
+
+func TestMappingApplies(t *testing.T) {
+	m := &Mapping{Module: "github.com/redis/go-redis/v9"}
+	if !m.Applies("github.com/redis/go-redis/v10") {
+		t.Fatal("expected the mapping to apply to other major versions")
+	}
+	if m.Applies("github.com/go-redis/redis/v9") {
+		t.Fatal("expected the mapping not to apply to other modules")
+	}
+	if !(&Mapping{}).Applies("example.com/mod") {
+		t.Fatal("expected a mapping without a module to apply")
+	}
+}
+
+func TestRemapPkgName(t *testing.T) {
+	opt := RemapOptions{
+		ModPath: "example.com/mod/v3",
+		OldPkgNames: map[string]string{
+			"example.com/mod/internal/pool":    "oldpool",
+			"example.com/mod/v2/internal/pool": "pool2",
+		},
+		NewPkgNames: map[string]string{
+			"example.com/mod/v3/pool": "connpool",
+		},
+	}
+	tests := []struct {
+		pkgpath, name string
+	}{
+		{"example.com/mod/v3/pool", "connpool"},
+		{"example.com/mod/v3/internal/pool", "pool2"},
+		{"example.com/mod/v3/go-util", "util"},
+	}
+	for _, tt := range tests {
+		if name := opt.pkgName(tt.pkgpath); name != tt.name {
+			t.Errorf("pkgName(%q) = %q, want %q", tt.pkgpath, name, tt.name)
+		}
+	}
+}
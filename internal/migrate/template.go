@@ -0,0 +1,527 @@
+package migrate
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/icholy/gomajor/internal/importpaths"
+	"github.com/icholy/gomajor/internal/packages"
+	"github.com/icholy/gomajor/internal/refactor"
+)
+
+// Template is an example-based rewrite in the style of eg. It's a Go file with
+// a before and an after function, which have the same parameters:
+//
+//	package template
+//
+//	import (
+//		"context"
+//
+//		"github.com/redis/go-redis/v9"
+//	)
+//
+//	func before(c *redis.Client, key string) *redis.StringCmd { return c.Get(key) }
+//	func after(c *redis.Client, key string) *redis.StringCmd { return c.Get(context.TODO(), key) }
+//
+// The body of each function is a single return or expression statement.
+// Expressions matching the before expression are replaced with the after expression.
+// The parameters are wildcards which match any expression of the parameter type,
+// or any expression at all if the type is any. The imports refer to the new version
+// of the module, because templates are applied after the imports are rewritten,
+// so the before expression doesn't have to type-check.
+type Template struct {
+	// Name is the template file name.
+	Name string
+	src  []byte
+	fset *token.FileSet
+	// params maps the wildcards to their type expressions.
+	params map[string]string
+	// imports maps the names of the template imports to their paths,
+	// and paths maps them back.
+	imports map[string]string
+	paths   map[string]string
+	before  ast.Expr
+	after   ast.Expr
+}
+
+// ReadTemplate reads and parses the template file.
+func ReadTemplate(name string) (*Template, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTemplate(name, data)
+}
+
+// ParseTemplate parses the template file data.
+func ParseTemplate(name string, data []byte) (*Template, error) {
+	t := &Template{
+		Name:    name,
+		src:     data,
+		fset:    token.NewFileSet(),
+		params:  map[string]string{},
+		imports: map[string]string{},
+		paths:   map[string]string{},
+	}
+	f, err := parser.ParseFile(t.fset, name, data, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range f.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			return nil, err
+		}
+		pkgname := packages.GuessName(path)
+		if spec.Name != nil {
+			pkgname = spec.Name.Name
+		}
+		t.imports[pkgname] = path
+		t.paths[path] = pkgname
+	}
+	funcs := map[string]*ast.FuncDecl{}
+	for _, decl := range f.Decls {
+		if fd, ok := decl.(*ast.FuncDecl); ok && fd.Recv == nil {
+			funcs[fd.Name.Name] = fd
+		}
+	}
+	before, after := funcs["before"], funcs["after"]
+	if before == nil || after == nil {
+		return nil, fmt.Errorf("%s: missing before or after function", name)
+	}
+	if types.ExprString(before.Type) != types.ExprString(after.Type) {
+		return nil, fmt.Errorf("%s: before and after have different signatures", name)
+	}
+	for _, field := range before.Type.Params.List {
+		for _, id := range field.Names {
+			t.params[id.Name] = types.ExprString(field.Type)
+		}
+	}
+	if t.before, err = t.body(before); err != nil {
+		return nil, err
+	}
+	if t.after, err = t.body(after); err != nil {
+		return nil, err
+	}
+	var unsupported ast.Node
+	ast.Inspect(t.before, func(n ast.Node) bool {
+		switch n.(type) {
+		case nil, *ast.Ident, *ast.BasicLit, *ast.ParenExpr, *ast.SelectorExpr, *ast.CallExpr,
+			*ast.StarExpr, *ast.UnaryExpr, *ast.BinaryExpr, *ast.IndexExpr:
+		default:
+			if unsupported == nil {
+				unsupported = n
+			}
+		}
+		return unsupported == nil
+	})
+	if unsupported != nil {
+		return nil, fmt.Errorf("%s: unsupported expression in before", t.fset.Position(unsupported.Pos()))
+	}
+	return t, nil
+}
+
+// body returns the expression of the function's only statement.
+func (t *Template) body(fd *ast.FuncDecl) (ast.Expr, error) {
+	if fd.Body == nil || len(fd.Body.List) != 1 {
+		return nil, fmt.Errorf("%s: %s must have a single statement", t.fset.Position(fd.Pos()), fd.Name.Name)
+	}
+	switch stmt := fd.Body.List[0].(type) {
+	case *ast.ReturnStmt:
+		if len(stmt.Results) == 1 {
+			return stmt.Results[0], nil
+		}
+	case *ast.ExprStmt:
+		return stmt.X, nil
+	}
+	return nil, fmt.Errorf("%s: %s must return a single expression", t.fset.Position(fd.Pos()), fd.Name.Name)
+}
+
+// Applies reports whether the template imports a package of the module path.
+func (t *Template) Applies(modpath string) bool {
+	matcher := importpaths.ModuleMatcher{Prefix: packages.ModPrefix(modpath)}
+	for path := range t.paths {
+		if m, _, ok := matcher.Match(path); ok && m == modpath {
+			return true
+		}
+	}
+	return false
+}
+
+// TemplateOptions specifies how to apply templates.
+type TemplateOptions struct {
+	// ModPath is the new module path. Only files which import it are changed.
+	ModPath   string
+	Templates []*Template
+	// Files limits the changes to the named Go files if it isn't nil.
+	Files []string
+	// LocalPrefix is used to group the added imports,
+	// like CommonOptions.LocalPrefix.
+	LocalPrefix string
+	// OnRewrite is called with every rewritten expression.
+	OnRewrite func(pos token.Position, old, new string)
+	// OnAmbiguous is called with every expression which has the shape of a
+	// before expression, but whose wildcard types can't be checked because
+	// of type errors. These expressions are left for manual review.
+	OnAmbiguous func(pos token.Position, old, reason string)
+}
+
+// ApplyTemplates type-checks the code in dir and replaces the expressions
+// which match the templates. When several templates match, the first one wins,
+// and expressions inside a replaced expression aren't matched. The imports
+// used by the after expressions are added to the files which need them.
+func ApplyTemplates(dir string, opt TemplateOptions) error {
+	if len(opt.Templates) == 0 {
+		return nil
+	}
+	pkgs, err := refactor.Load(dir, "./...")
+	if err != nil {
+		return err
+	}
+	scope, err := importpaths.FileSet(opt.Files)
+	if err != nil {
+		return err
+	}
+	matcher := importpaths.ModuleMatcher{Prefix: packages.ModPrefix(opt.ModPath)}
+	var ed refactor.Editor
+	type ambiguous struct {
+		pos         token.Position
+		old, reason string
+	}
+	var review []ambiguous
+	seen := map[string]bool{}
+	rewrites := map[token.Position]bool{}
+	for _, pkg := range pkgs {
+		for _, f := range pkg.Syntax {
+			name := pkg.Fset.PositionFor(f.Pos(), false).Filename
+			if seen[name] || (scope != nil && !scope[name]) || !importsModule(f, matcher, opt.ModPath) {
+				continue
+			}
+			seen[name] = true
+			src, err := os.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			a := applier{
+				fset:     pkg.Fset,
+				info:     pkg.TypesInfo,
+				file:     f,
+				src:      src,
+				ed:       &ed,
+				rewrites: rewrites,
+				missing:  map[string]string{},
+				local:    opt.LocalPrefix,
+			}
+			a.apply(opt.Templates, func(pos token.Position, old, reason string) {
+				review = append(review, ambiguous{pos, old, reason})
+			})
+			a.addImports()
+		}
+	}
+	sort.SliceStable(review, func(i, j int) bool {
+		pi, pj := review[i].pos, review[j].pos
+		if pi.Filename != pj.Filename {
+			return pi.Filename < pj.Filename
+		}
+		return pi.Offset < pj.Offset
+	})
+	if opt.OnAmbiguous != nil {
+		for _, r := range review {
+			opt.OnAmbiguous(r.pos, r.old, r.reason)
+		}
+	}
+	return ed.Write(func(pos token.Position, old, new string) {
+		// added imports aren't reported
+		if rewrites[pos] && opt.OnRewrite != nil {
+			opt.OnRewrite(pos, old, new)
+		}
+	})
+}
+
+// importsModule reports whether the file imports a package of the module path.
+func importsModule(f *ast.File, matcher importpaths.ModuleMatcher, modpath string) bool {
+	for _, spec := range f.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		if m, _, ok := matcher.Match(path); ok && m == modpath {
+			return true
+		}
+	}
+	return false
+}
+
+// applier applies templates to a type-checked file.
+type applier struct {
+	fset *token.FileSet
+	info *types.Info
+	file *ast.File
+	src  []byte
+	ed   *refactor.Editor
+	// rewrites contains the positions of the replaced expressions
+	rewrites map[token.Position]bool
+	// missing maps the import paths used by after expressions
+	// which the file doesn't import to their package names.
+	missing map[string]string
+	// local is the LocalPrefix of the options
+	local string
+}
+
+// apply records the replacements of the expressions matching the templates.
+func (a *applier) apply(templates []*Template, review func(pos token.Position, old, reason string)) {
+	ast.Inspect(a.file, func(n ast.Node) bool {
+		x, ok := n.(ast.Expr)
+		if !ok {
+			return true
+		}
+		for _, t := range templates {
+			m := match{t: t, a: a, bindings: map[string]ast.Expr{}}
+			if !m.expr(t.before, x) {
+				continue
+			}
+			if len(m.unknown) > 0 {
+				review(a.position(x.Pos()), a.text(x), fmt.Sprintf("matches %s but the type of %s is unknown",
+					filepath.Base(t.Name), strings.Join(m.unknown, ", ")))
+				return true
+			}
+			pos := a.position(x.Pos())
+			a.ed.ReplaceText(pos, a.text(x), a.substitute(t, m.bindings))
+			a.rewrites[pos] = true
+			return false
+		}
+		return true
+	})
+}
+
+// position returns the unadjusted position, which the editor needs.
+func (a *applier) position(pos token.Pos) token.Position {
+	return a.fset.PositionFor(pos, false)
+}
+
+// text returns the source text of the node.
+func (a *applier) text(n ast.Node) string {
+	return string(a.src[a.position(n.Pos()).Offset:a.position(n.End()).Offset])
+}
+
+// substitute returns the after expression of the template with the wildcards
+// replaced by the bound expressions, and the template's package names replaced
+// by the ones used in the file.
+func (a *applier) substitute(t *Template, bindings map[string]ast.Expr) string {
+	type edit struct {
+		start, end int
+		text       string
+	}
+	offset := func(pos token.Pos) int {
+		return t.fset.Position(pos).Offset
+	}
+	// selected identifiers are never wildcards
+	sels := map[*ast.Ident]bool{}
+	ast.Inspect(t.after, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			sels[sel.Sel] = true
+		}
+		return true
+	})
+	var edits []edit
+	var stack []ast.Node
+	ast.Inspect(t.after, func(n ast.Node) bool {
+		if n == nil {
+			stack = stack[:len(stack)-1]
+			return true
+		}
+		var parent ast.Node
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1]
+		}
+		stack = append(stack, n)
+		id, ok := n.(*ast.Ident)
+		if !ok || sels[id] {
+			return true
+		}
+		if bound, ok := bindings[id.Name]; ok {
+			text := a.text(bound)
+			if needsParens(bound, parent) {
+				text = "(" + text + ")"
+			}
+			edits = append(edits, edit{offset(id.Pos()), offset(id.End()), text})
+		} else if path, ok := t.imports[id.Name]; ok {
+			if sel, ok := parent.(*ast.SelectorExpr); ok && sel.X == id {
+				edits = append(edits, edit{offset(id.Pos()), offset(id.End()), a.pkgname(path, id.Name)})
+			}
+		}
+		return true
+	})
+	start, end := offset(t.after.Pos()), offset(t.after.End())
+	var b strings.Builder
+	last := start
+	for _, e := range edits {
+		b.Write(t.src[last:e.start])
+		b.WriteString(e.text)
+		last = e.end
+	}
+	b.Write(t.src[last:end])
+	return b.String()
+}
+
+// needsParens reports whether the bound expression must be parenthesized
+// where it replaces a wildcard. Operands are only parenthesized when they
+// are operated on, not when they're passed as arguments.
+func needsParens(bound ast.Expr, parent ast.Node) bool {
+	switch bound.(type) {
+	case *ast.BinaryExpr, *ast.UnaryExpr, *ast.StarExpr:
+	default:
+		return false
+	}
+	switch parent.(type) {
+	case nil, *ast.CallExpr, *ast.KeyValueExpr, *ast.CompositeLit:
+		return false
+	}
+	return true
+}
+
+// pkgname returns the name the file uses for the imported package. If the file
+// doesn't import it, it's added using the template's name.
+func (a *applier) pkgname(path, name string) string {
+	for _, spec := range a.file.Imports {
+		if p, err := strconv.Unquote(spec.Path.Value); err != nil || p != path {
+			continue
+		}
+		if spec.Name != nil {
+			return spec.Name.Name
+		}
+		if pkgname, ok := a.info.Implicits[spec].(*types.PkgName); ok {
+			return pkgname.Name()
+		}
+		return packages.GuessName(path)
+	}
+	a.missing[path] = name
+	return name
+}
+
+// addImports records the insertion of the missing imports,
+// which are grouped the way the import rewriting groups them.
+func (a *applier) addImports() {
+	if len(a.missing) == 0 {
+		return
+	}
+	imports := map[string]string{}
+	for path, name := range a.missing {
+		if name == packages.GuessName(path) {
+			name = ""
+		}
+		imports[path] = name
+	}
+	tf := a.fset.File(a.file.Pos())
+	start, end, text := importpaths.AddImports(tf, a.src, a.file, imports, a.local)
+	a.ed.ReplaceText(tf.PositionFor(tf.Pos(start), false), string(a.src[start:end]), text)
+}
+
+// match is an attempt to match a template's before expression.
+type match struct {
+	t        *Template
+	a        *applier
+	bindings map[string]ast.Expr
+	// unknown contains the wildcards whose types couldn't be checked
+	unknown []string
+}
+
+// expr reports whether the expression x matches the pattern.
+func (m *match) expr(pattern, x ast.Expr) bool {
+	pattern, x = ast.Unparen(pattern), ast.Unparen(x)
+	switch p := pattern.(type) {
+	case *ast.Ident:
+		if typ, ok := m.t.params[p.Name]; ok {
+			return m.wildcard(p.Name, typ, x)
+		}
+		x, ok := x.(*ast.Ident)
+		return ok && x.Name == p.Name
+	case *ast.BasicLit:
+		x, ok := x.(*ast.BasicLit)
+		return ok && x.Kind == p.Kind && x.Value == p.Value
+	case *ast.SelectorExpr:
+		x, ok := x.(*ast.SelectorExpr)
+		if !ok || x.Sel.Name != p.Sel.Name {
+			return false
+		}
+		if id, ok := p.X.(*ast.Ident); ok && m.t.params[id.Name] == "" {
+			if path, ok := m.t.imports[id.Name]; ok {
+				return m.pkg(path, x.X)
+			}
+		}
+		return m.expr(p.X, x.X)
+	case *ast.CallExpr:
+		x, ok := x.(*ast.CallExpr)
+		if !ok || len(x.Args) != len(p.Args) || x.Ellipsis.IsValid() != p.Ellipsis.IsValid() {
+			return false
+		}
+		if !m.expr(p.Fun, x.Fun) {
+			return false
+		}
+		for i := range p.Args {
+			if !m.expr(p.Args[i], x.Args[i]) {
+				return false
+			}
+		}
+		return true
+	case *ast.StarExpr:
+		x, ok := x.(*ast.StarExpr)
+		return ok && m.expr(p.X, x.X)
+	case *ast.UnaryExpr:
+		x, ok := x.(*ast.UnaryExpr)
+		return ok && x.Op == p.Op && m.expr(p.X, x.X)
+	case *ast.BinaryExpr:
+		x, ok := x.(*ast.BinaryExpr)
+		return ok && x.Op == p.Op && m.expr(p.X, x.X) && m.expr(p.Y, x.Y)
+	case *ast.IndexExpr:
+		x, ok := x.(*ast.IndexExpr)
+		return ok && m.expr(p.X, x.X) && m.expr(p.Index, x.Index)
+	}
+	return false
+}
+
+// pkg reports whether x refers to the imported package.
+func (m *match) pkg(path string, x ast.Expr) bool {
+	id, ok := x.(*ast.Ident)
+	if !ok {
+		return false
+	}
+	pkgname, ok := m.a.info.Uses[id].(*types.PkgName)
+	return ok && pkgname.Imported().Path() == path
+}
+
+// wildcard binds the expression to the wildcard if its type matches.
+// A wildcard which is used more than once must match the same expression.
+func (m *match) wildcard(name, typ string, x ast.Expr) bool {
+	if bound, ok := m.bindings[name]; ok {
+		return m.a.text(bound) == m.a.text(x)
+	}
+	if typ != "any" && typ != "interface{}" {
+		t := m.a.info.TypeOf(x)
+		if t == nil || t == types.Typ[types.Invalid] {
+			m.unknown = append(m.unknown, name)
+		} else if m.typeString(types.Default(t)) != typ {
+			return false
+		}
+	}
+	m.bindings[name] = x
+	return true
+}
+
+// typeString formats the type using the template's package names.
+func (m *match) typeString(t types.Type) string {
+	return types.TypeString(t, func(pkg *types.Package) string {
+		if name, ok := m.t.paths[pkg.Path()]; ok {
+			return name
+		}
+		return pkg.Path()
+	})
+}
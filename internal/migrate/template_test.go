@@ -0,0 +1,139 @@
+package migrate
+
+import (
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTemplate(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{
+			name: "valid",
+			data: `package template
+
+import "strings"
+
+func before(s, old, new string) string { return strings.Replace(s, old, new, -1) }
+func after(s, old, new string) string { return strings.ReplaceAll(s, old, new) }
+`,
+		},
+		{
+			name: "missing after",
+			data: "package template\n\nfunc before(s string) string { return s }\n",
+			err:  "template.go: missing before or after function",
+		},
+		{
+			name: "different signatures",
+			data: `package template
+
+func before(s string) string { return s }
+func after(s []byte) string { return string(s) }
+`,
+			err: "template.go: before and after have different signatures",
+		},
+		{
+			name: "multiple statements",
+			data: `package template
+
+func before(s string) string { println(s); return s }
+func after(s string) string { return s }
+`,
+			err: "template.go:3:1: before must have a single statement",
+		},
+		{
+			name: "unsupported expression",
+			data: `package template
+
+func before(s string) string { return func() string { return s }() }
+func after(s string) string { return s }
+`,
+			err: "template.go:3:39: unsupported expression in before",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseTemplate("template.go", []byte(tt.data))
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("error = %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestApplyTemplates(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod": "module example.com/app\n\ngo 1.21\n",
+		"main.go": `package main
+
+import (
+	"fmt"
+	str "strings"
+)
+
+func main() {
+	a, b := "a", "b"
+	fmt.Println(str.Replace(a+b, "a", "b", -1))
+	fmt.Println(str.Replace(a, b, "c", 1))
+	fmt.Println(str.Replace(a, b, missing, -1))
+}
+`,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmpl, err := ParseTemplate("replace.go", []byte(`package template
+
+import "strings"
+
+func before(s, old, new string) string { return strings.Replace(s, old, new, -1) }
+func after(s, old, new string) string { return strings.ReplaceAll(s, old, new) }
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rewrites, review []string
+	err = ApplyTemplates(dir, TemplateOptions{
+		ModPath:   "strings",
+		Templates: []*Template{tmpl},
+		OnRewrite: func(pos token.Position, old, new string) {
+			rewrites = append(rewrites, old+" -> "+new)
+		},
+		OnAmbiguous: func(pos token.Position, old, reason string) {
+			review = append(review, old+": "+reason)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`str.Replace(a+b, "a", "b", -1) -> str.ReplaceAll(a+b, "a", "b")`}
+	if strings.Join(rewrites, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("rewrites = %q, want %q", rewrites, want)
+	}
+	want = []string{`str.Replace(a, b, missing, -1): matches replace.go but the type of new is unknown`}
+	if strings.Join(review, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("review = %q, want %q", review, want)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `fmt.Println(str.ReplaceAll(a+b, "a", "b"))`) {
+		t.Fatalf("main.go wasn't rewritten:\n%s", data)
+	}
+}
@@ -15,7 +15,7 @@ func TestLatestIntegration(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt, func(t *testing.T) {
-			mod, err := Latest(tt, true, true)
+			mod, err := Latest(tt, true, true, nil)
 			if err != nil {
 				t.Fatal(err)
 			}
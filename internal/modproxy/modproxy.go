@@ -1,10 +1,14 @@
 package modproxy
 
 import (
+	"archive/zip"
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"go/parser"
+	"go/token"
 	"io"
 	"net/http"
 	"net/url"
@@ -18,6 +22,7 @@ import (
 	"golang.org/x/mod/modfile"
 	"golang.org/x/mod/module"
 	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/icholy/gomajor/internal/goenv"
@@ -104,6 +109,9 @@ func fileRequest(proxy *url.URL, path string) (*http.Response, error) {
 type Module struct {
 	Path     string
 	Versions []string
+	// Excluded is set by Latest when the best version was
+	// skipped because it's excluded.
+	Excluded *module.Version
 }
 
 // MaxVersion returns the latest version of the module in the list.
@@ -148,6 +156,17 @@ func (m *Module) Retract(r Retractions) *Module {
 	}
 }
 
+// Exclude returns a copy of m with the excluded versions removed.
+func (m *Module) Exclude(e Exclusions) *Module {
+	versions := slices.Clone(m.Versions)
+	return &Module{
+		Path: m.Path,
+		Versions: slices.DeleteFunc(versions, func(v string) bool {
+			return e.Includes(m.Path, v)
+		}),
+	}
+}
+
 // IsNewerVersion returns true if newversion is greater than oldversion in terms of semver.
 // If major is true, then newversion must be a major version ahead of oldversion to be considered newer.
 func IsNewerVersion(oldversion, newversion string, major bool) bool {
@@ -261,7 +280,8 @@ var ErrNoVersions = errors.New("no module versions found")
 // Latest finds the latest major version of a module
 // cached sets the Disable-Module-Fetch: true header
 // pre controls whether to return modules which only contain pre-release versions.
-func Latest(modpath string, cached, pre bool) (*Module, error) {
+// Excluded versions are skipped, and the best one is recorded in the Excluded field.
+func Latest(modpath string, cached, pre bool, excluded Exclusions) (*Module, error) {
 	mods, err := List(modpath, cached)
 	if err != nil {
 		return nil, err
@@ -275,10 +295,22 @@ func Latest(modpath string, cached, pre bool) (*Module, error) {
 			return nil, err
 		}
 	}
-	mod, _ := MaxVersion(mods, pre, r)
+	mod, best := MaxVersion(mods, pre, r)
 	if mod == nil {
 		return nil, ErrNoVersions
 	}
+	if !excluded.Includes(mod.Path, best) {
+		return mod, nil
+	}
+	skipped := module.Version{Path: mod.Path, Version: best}
+	for i, m := range mods {
+		mods[i] = m.Exclude(excluded)
+	}
+	mod, _ = MaxVersion(mods, pre, r)
+	if mod == nil {
+		return nil, fmt.Errorf("%s@%s is excluded", skipped.Path, skipped.Version)
+	}
+	mod.Excluded = &skipped
 	return mod, nil
 }
 
@@ -396,6 +428,120 @@ func FetchRetractions(mod *Module) (Retractions, error) {
 	return retractions, nil
 }
 
+// FetchZip fetches the zip file of the module version.
+func FetchZip(mod module.Version, cached bool) (*zip.Reader, error) {
+	data, err := fetchZip(mod, cached)
+	if err != nil {
+		return nil, err
+	}
+	return zip.NewReader(bytes.NewReader(data), int64(len(data)))
+}
+
+// Download fetches the zip file of the module version and extracts it into dir,
+// which must be empty or not exist. The zip file is checked like the go command does.
+func Download(mod module.Version, dir string, cached bool) error {
+	data, err := fetchZip(mod, cached)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp("", "gomajor-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return modzip.Unzip(dir, mod, f.Name())
+}
+
+// fetchZip returns the contents of the module version's zip file.
+func fetchZip(mod module.Version, cached bool) ([]byte, error) {
+	escaped, err := module.EscapePath(mod.Path)
+	if err != nil {
+		return nil, err
+	}
+	version, err := module.EscapeVersion(mod.Version)
+	if err != nil {
+		return nil, err
+	}
+	res, err := Request(path.Join(escaped, "@v", version+".zip"), cached)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		msg := string(body)
+		if msg == "" {
+			msg = res.Status
+		}
+		return nil, fmt.Errorf("proxy: %s", msg)
+	}
+	return body, nil
+}
+
+// PackageNames returns the declared package names of the packages in
+// the module version. The map is keyed by package directory. Files which
+// are excluded by the ignore build tag, like generators, aren't counted,
+// and the most common name is used if the other files don't agree.
+func PackageNames(mod module.Version, cached bool) (map[string]string, error) {
+	zr, err := FetchZip(mod, cached)
+	if err != nil {
+		return nil, err
+	}
+	prefix := mod.Path + "@" + mod.Version + "/"
+	counts := map[string]map[string]int{}
+	for _, f := range zr.File {
+		name, ok := strings.CutPrefix(f.Name, prefix)
+		if !ok || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		pkgdir := path.Dir(name)
+		if pkgdir == "." {
+			pkgdir = ""
+		}
+		if slices.Contains(strings.Split(pkgdir, "/"), "testdata") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		file, err := parser.ParseFile(token.NewFileSet(), name, rc, parser.PackageClauseOnly|parser.ParseComments)
+		rc.Close()
+		if err != nil || file.Name.Name == "documentation" {
+			continue
+		}
+		expr, err := packages.BuildConstraint(file)
+		if err != nil || expr != nil && !expr.Eval(func(tag string) bool { return tag != "ignore" }) {
+			continue
+		}
+		if counts[pkgdir] == nil {
+			counts[pkgdir] = map[string]int{}
+		}
+		counts[pkgdir][file.Name.Name]++
+	}
+	names := map[string]string{}
+	for pkgdir, count := range counts {
+		var best string
+		for name, n := range count {
+			if best == "" || n > count[best] || n == count[best] && name < best {
+				best = name
+			}
+		}
+		names[pkgdir] = best
+	}
+	return names, nil
+}
+
 // VersionRange is an inclusive version range.
 type VersionRange struct {
 	Low, High string
@@ -419,12 +565,22 @@ func (rr Retractions) Includes(v string) bool {
 	return false
 }
 
+// Exclusions is a list of excluded module versions.
+type Exclusions []module.Version
+
+// Includes reports whether version v of the module is excluded
+func (ee Exclusions) Includes(path, v string) bool {
+	return slices.Contains(ee, module.Version{Path: path, Version: v})
+}
+
 // Update reports a newer version of a module.
 // The Err field will be set if an error occured.
 type Update struct {
-	Module module.Version
+	Module packages.Dependency
 	Latest module.Version
-	Err    error
+	// Excluded is a newer version which was skipped because it's excluded.
+	Excluded *module.Version
+	Err      error
 }
 
 // MarshalJSON implements json.Marshaler
@@ -434,13 +590,15 @@ func (u Update) MarshalJSON() ([]byte, error) {
 		err = u.Err.Error()
 	}
 	return json.Marshal(struct {
-		Module module.Version
-		Latest module.Version
-		Err    string `json:",omitempty"`
+		Module   packages.Dependency
+		Latest   module.Version
+		Excluded *module.Version `json:",omitempty"`
+		Err      string          `json:",omitempty"`
 	}{
-		Module: u.Module,
-		Latest: u.Latest,
-		Err:    err,
+		Module:   u.Module,
+		Latest:   u.Latest,
+		Excluded: u.Excluded,
+		Err:      err,
 	})
 }
 
@@ -450,7 +608,8 @@ type UpdateOptions struct {
 	Pre      bool
 	Cached   bool
 	Major    bool
-	Modules  []module.Version
+	Modules  []packages.Dependency
+	Excluded Exclusions
 	OnUpdate func(Update)
 }
 
@@ -472,7 +631,7 @@ func Updates(opt UpdateOptions) {
 				continue
 			}
 			group.Go(func() error {
-				mod, err := Latest(m.Path, opt.Cached, opt.Pre)
+				mod, err := Latest(m.Path, opt.Cached, opt.Pre, opt.Excluded)
 				if err == ErrNoVersions {
 					return nil
 				}
@@ -482,13 +641,17 @@ func Updates(opt UpdateOptions) {
 				}
 				v := mod.MaxVersion("", opt.Pre)
 				if IsNewerVersion(m.Version, v, opt.Major) {
-					ch <- Update{
+					u := Update{
 						Module: m,
 						Latest: module.Version{
 							Path:    mod.WithMajorPath(v),
 							Version: v,
 						},
 					}
+					if mod.Excluded != nil && IsNewerVersion(m.Version, mod.Excluded.Version, opt.Major) {
+						u.Excluded = mod.Excluded
+					}
+					ch <- u
 				}
 				return nil
 			})
@@ -4,6 +4,8 @@ import (
 	"reflect"
 	"testing"
 
+	"golang.org/x/mod/module"
+
 	"github.com/icholy/gomajor/internal/modproxy/testmodproxy"
 )
 
@@ -279,10 +281,11 @@ func TestQuery(t *testing.T) {
 
 func TestLatest(t *testing.T) {
 	tests := []struct {
-		name    string
-		modpath string
-		pre     bool
-		want    *Module
+		name     string
+		modpath  string
+		pre      bool
+		excluded Exclusions
+		want     *Module
 	}{
 		{
 			name:    "latest from v1 base",
@@ -311,6 +314,27 @@ func TestLatest(t *testing.T) {
 				Versions: []string{"v3.0.0"},
 			},
 		},
+		{
+			name:     "latest excluded",
+			modpath:  "example.com/testmod",
+			pre:      false,
+			excluded: Exclusions{{Path: "example.com/testmod/v3", Version: "v3.0.0"}},
+			want: &Module{
+				Path:     "example.com/testmod/v2",
+				Versions: []string{"v2.0.0", "v2.1.0"},
+				Excluded: &module.Version{Path: "example.com/testmod/v3", Version: "v3.0.0"},
+			},
+		},
+		{
+			name:     "older version excluded",
+			modpath:  "example.com/testmod",
+			pre:      false,
+			excluded: Exclusions{{Path: "example.com/testmod/v2", Version: "v2.1.0"}},
+			want: &Module{
+				Path:     "example.com/testmod/v3",
+				Versions: []string{"v3.0.0"},
+			},
+		},
 	}
 	proxies := testmodproxy.LoadProxies(t, "testdata/modules")
 	for _, proxy := range proxies {
@@ -318,7 +342,7 @@ func TestLatest(t *testing.T) {
 			t.Setenv("GOPROXY", proxy.URL)
 			for _, tt := range tests {
 				t.Run(tt.name, func(t *testing.T) {
-					mod, err := Latest(tt.modpath, false, tt.pre)
+					mod, err := Latest(tt.modpath, false, tt.pre, tt.excluded)
 					if err != nil {
 						t.Fatal(err)
 					}
@@ -372,3 +396,23 @@ func TestQueryPackage(t *testing.T) {
 		})
 	}
 }
+
+func TestPackageNames(t *testing.T) {
+	want := map[string]string{
+		"":    "pkgname",
+		"sub": "other",
+	}
+	proxies := testmodproxy.LoadProxies(t, "testdata/modules")
+	for _, proxy := range proxies {
+		t.Run(proxy.Name, func(t *testing.T) {
+			t.Setenv("GOPROXY", proxy.URL)
+			names, err := PackageNames(module.Version{Path: "example.com/pkgname", Version: "v1.0.0"}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names, want) {
+				t.Fatalf("PackageNames() = %v, want %v", names, want)
+			}
+		})
+	}
+}
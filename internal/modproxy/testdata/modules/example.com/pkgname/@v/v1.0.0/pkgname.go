@@ -0,0 +1,3 @@
+package pkgname
+
+const Version = "v1.0.0"
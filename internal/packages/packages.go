@@ -1,15 +1,28 @@
 package packages
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"go/ast"
+	"go/build/constraint"
+	"go/parser"
+	"go/token"
+	"io/fs"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"unicode"
 
 	"golang.org/x/mod/modfile"
 	"golang.org/x/mod/module"
 	"golang.org/x/mod/semver"
+
+	"github.com/icholy/gomajor/internal/goenv"
 )
 
 // ModPrefix returns the module path with no SIV
@@ -57,6 +70,24 @@ func SplitPath(modprefix, pkgpath string) (modpath, pkgdir string, ok bool) {
 	return modpath, pkgdir, true
 }
 
+// GuessName returns the package name tools assume for the package path.
+// Major version suffixes and "go-" prefixes are removed, and the name
+// is truncated at the first character which isn't valid in an identifier.
+func GuessName(pkgpath string) string {
+	elems := strings.Split(pkgpath, "/")
+	name := elems[len(elems)-1]
+	if len(elems) > 1 && semver.Major(name) == name && name != "" {
+		name = elems[len(elems)-2]
+	}
+	name = strings.TrimPrefix(name, "go-")
+	if i := strings.IndexFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	}); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
 // SplitSpec splits the path/to/package@query format strings
 func SplitSpec(spec string) (path, query string) {
 	parts := strings.SplitN(spec, "@", 2)
@@ -116,8 +147,167 @@ func FindModFile(dir string) (string, error) {
 	}
 }
 
-// Direct returns a list of all modules that are direct dependencies
-func Direct(dir string) ([]module.Version, error) {
+// FindWorkFile finds the go.work file which applies to dir.
+// Like the go command, the GOWORK environment variable takes precedence
+// over searching the parent directories. If there's no go.work file,
+// the empty string is returned.
+func FindWorkFile(dir string) (string, error) {
+	switch gowork := os.Getenv("GOWORK"); gowork {
+	case "off":
+		return "", nil
+	case "", "auto":
+	default:
+		return filepath.Abs(gowork)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		name := filepath.Join(dir, "go.work")
+		_, err := os.Stat(name)
+		if err == nil {
+			return name, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// Modules returns the root directories of the modules in the workspace which dir belongs to.
+// If there is no go.work file, only the root directory of the enclosing module is returned.
+func Modules(dir string) ([]string, error) {
+	workname, err := FindWorkFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	if workname == "" {
+		name, err := FindModFile(dir)
+		if err != nil {
+			return nil, err
+		}
+		return []string{filepath.Dir(name)}, nil
+	}
+	data, err := os.ReadFile(workname)
+	if err != nil {
+		return nil, err
+	}
+	work, err := modfile.ParseWork(workname, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, u := range work.Use {
+		moddir := filepath.FromSlash(u.Path)
+		if !filepath.IsAbs(moddir) {
+			moddir = filepath.Join(filepath.Dir(workname), moddir)
+		}
+		dirs = append(dirs, moddir)
+	}
+	return dirs, nil
+}
+
+// ModulePaths returns the module paths of the module root directories,
+// such as the workspace modules returned by Modules.
+func ModulePaths(moddirs []string) (map[string]bool, error) {
+	paths := map[string]bool{}
+	for _, moddir := range moddirs {
+		file, err := ReadModFile(moddir)
+		if err != nil {
+			return nil, err
+		}
+		if file.Module != nil {
+			paths[file.Module.Mod.Path] = true
+		}
+	}
+	return paths, nil
+}
+
+// WalkOptions enables walking directories which WalkModule skips by default.
+type WalkOptions struct {
+	// Testdata enables walking testdata directories. The modules
+	// in them are test fixtures, so they're walked too.
+	Testdata bool
+	// Hidden enables walking dot-prefix and underscore-prefix directories.
+	// The .git directory is always skipped.
+	Hidden bool
+	// Nested enables walking the directories of nested modules.
+	Nested bool
+}
+
+// WalkModule walks the files of the module rooted at dir like filepath.WalkDir.
+// The directories which don't contain the module's code are skipped: vendor,
+// node_modules, .git, testdata, dot-prefix and underscore-prefix directories,
+// and the directories of nested modules.
+func WalkModule(dir string, opt WalkOptions, fn fs.WalkDirFunc) error {
+	return filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && name != dir && skipDir(dir, name, opt) {
+			return filepath.SkipDir
+		}
+		return fn(name, d, err)
+	})
+}
+
+// skipDir reports whether WalkModule skips the directory in dir.
+func skipDir(dir, name string, opt WalkOptions) bool {
+	switch base := filepath.Base(name); {
+	case base == "vendor", base == "node_modules", base == ".git":
+		return true
+	case base == "testdata":
+		return !opt.Testdata
+	case strings.HasPrefix(base, "."), strings.HasPrefix(base, "_"):
+		return !opt.Hidden
+	}
+	if opt.Nested || opt.Testdata && InTestdata(dir, name) {
+		return false
+	}
+	// directories whose go.mod can't be checked are skipped too
+	_, err := os.Lstat(filepath.Join(name, "go.mod"))
+	return !os.IsNotExist(err)
+}
+
+// InTestdata reports whether name is in a testdata directory below dir.
+func InTestdata(dir, name string) bool {
+	rel, err := filepath.Rel(dir, name)
+	if err != nil {
+		return false
+	}
+	return slices.Contains(strings.Split(filepath.ToSlash(rel), "/"), "testdata")
+}
+
+// Nested returns the root directories of the modules nested in dir, starting with dir itself.
+// Like import rewriting, underscore-prefix, dot-prefix, vendor, testdata, and node_modules
+// directories are skipped.
+func Nested(dir string) ([]string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	err = WalkModule(dir, WalkOptions{Nested: true}, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(name, "go.mod")); err == nil {
+			dirs = append(dirs, name)
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// ReadModFile parses the go.mod which applies to dir.
+// Unlike modfile.ParseLax, the replace and exclude directives are included.
+func ReadModFile(dir string) (*modfile.File, error) {
 	name, err := FindModFile(dir)
 	if err != nil {
 		return nil, err
@@ -126,18 +316,582 @@ func Direct(dir string) ([]module.Version, error) {
 	if err != nil {
 		return nil, err
 	}
-	file, err := modfile.ParseLax(name, data, nil)
+	return modfile.Parse(name, data, nil)
+}
+
+// EditModFile parses the go.mod which applies to dir and passes it to edit.
+// The go.mod is written back if it was changed.
+func EditModFile(dir string, edit func(file *modfile.File) error) error {
+	name, err := FindModFile(dir)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	file, err := modfile.Parse(name, data, nil)
+	if err != nil {
+		return err
+	}
+	if err := edit(file); err != nil {
+		return err
+	}
+	file.Cleanup()
+	formatted, err := file.Format()
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data, formatted) {
+		return nil
+	}
+	return os.WriteFile(name, formatted, 0)
+}
+
+// RenameRequire changes the module path of a requirement in the go.mod which applies to dir.
+// The version is kept, and an error is returned if it isn't valid for the new path, because
+// the right version of the new path can't be known. It reports whether the module was required.
+func RenameRequire(dir, oldpath, newpath string) (bool, error) {
+	var found bool
+	err := EditModFile(dir, func(file *modfile.File) error {
+		for _, req := range file.Require {
+			if req.Mod.Path != oldpath {
+				continue
+			}
+			found = true
+			version := req.Mod.Version
+			if err := module.Check(newpath, version); err != nil {
+				return fmt.Errorf("require %w", err)
+			}
+			if err := file.DropRequire(oldpath); err != nil {
+				return err
+			}
+			file.AddNewRequire(newpath, version, req.Indirect)
+			return nil
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Dependency is a module required by go.mod.
+type Dependency struct {
+	Path    string
+	Version string
+	// Replace is the module's replacement or nil if it's not replaced.
+	// Local filesystem replacements have an empty version.
+	Replace *module.Version `json:",omitempty"`
+	// Indirect is set for requirements marked with an // indirect comment.
+	Indirect bool
+	// Via lists the direct dependencies which require an indirect dependency.
+	Via []string `json:",omitempty"`
+	// Tool is set for modules which provide tools. See Tools.
+	Tool bool
+}
+
+// Module returns the required module version.
+func (d Dependency) Module() module.Version {
+	return module.Version{Path: d.Path, Version: d.Version}
+}
+
+// IsLocal reports whether the module is replaced by a local directory.
+func (d Dependency) IsLocal() bool {
+	return d.Replace != nil && d.Replace.Version == ""
+}
+
+// Direct returns a list of all modules that are direct dependencies
+func Direct(dir string) ([]Dependency, error) {
+	deps, err := Requirements(dir)
+	if err != nil {
+		return nil, err
+	}
+	var direct []Dependency
+	for _, d := range deps {
+		if !d.Indirect {
+			direct = append(direct, d)
+		}
+	}
+	return direct, nil
+}
+
+// Requirements returns a list of all the modules required by the go.mod
+// which applies to dir, including indirect dependencies.
+func Requirements(dir string) ([]Dependency, error) {
+	file, err := ReadModFile(dir)
 	if err != nil {
 		return nil, err
 	}
-	var mods []module.Version
+	var deps []Dependency
 	for _, req := range file.Require {
-		if !req.Indirect {
-			mods = append(mods, req.Mod)
+		deps = append(deps, Dependency{
+			Path:     req.Mod.Path,
+			Version:  req.Mod.Version,
+			Replace:  replacement(file, req.Mod),
+			Indirect: req.Indirect,
+		})
+	}
+	sort.Slice(deps, func(i, j int) bool {
+		return deps[i].Path < deps[j].Path
+	})
+	return deps, nil
+}
+
+// Tools returns the package paths of the tools used by the module which dir belongs to.
+// They're read from the go.mod tool directives, and the blank imports of files which are
+// only built with the tools build tag, following the tools.go convention.
+func Tools(dir string) ([]string, error) {
+	file, err := ReadModFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	var tools []string
+	for _, t := range file.Tool {
+		tools = append(tools, t.Path)
+	}
+	moddir := filepath.Dir(file.Syntax.Name)
+	err = WalkModule(moddir, WalkOptions{}, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(name, ".go") {
+			return nil
+		}
+		imports, err := toolImports(name)
+		if err != nil {
+			return err
+		}
+		for _, path := range imports {
+			if !slices.Contains(tools, path) {
+				tools = append(tools, path)
+			}
+		}
+		return nil
+	})
+	return tools, err
+}
+
+// toolImports returns the blank imports in the file if it's only built with the tools tag.
+func toolImports(name string) ([]string, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, name, nil, parser.ImportsOnly|parser.ParseComments)
+	if err != nil {
+		// files which don't parse can't be built as tools either
+		return nil, nil
+	}
+	expr, err := BuildConstraint(f)
+	if err != nil || expr == nil || !expr.Eval(func(tag string) bool { return tag == "tools" }) ||
+		expr.Eval(func(string) bool { return false }) {
+		return nil, nil
+	}
+	var imports []string
+	for _, spec := range f.Imports {
+		if spec.Name != nil && spec.Name.Name == "_" {
+			path, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				return nil, err
+			}
+			imports = append(imports, path)
+		}
+	}
+	return imports, nil
+}
+
+// BuildConstraint returns the build constraint of the file, which must be parsed
+// with comments, or nil if it doesn't have one. A //go:build line takes precedence
+// over // +build lines, which are combined.
+func BuildConstraint(f *ast.File) (constraint.Expr, error) {
+	var gobuild, plusbuild constraint.Expr
+	for _, g := range f.Comments {
+		if g.Pos() > f.Package {
+			break
+		}
+		for _, c := range g.List {
+			if !constraint.IsGoBuild(c.Text) && !constraint.IsPlusBuild(c.Text) {
+				continue
+			}
+			expr, err := constraint.Parse(c.Text)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case constraint.IsGoBuild(c.Text):
+				gobuild = expr
+			case plusbuild == nil:
+				plusbuild = expr
+			default:
+				plusbuild = &constraint.AndExpr{X: plusbuild, Y: expr}
+			}
+		}
+	}
+	if gobuild != nil {
+		return gobuild, nil
+	}
+	return plusbuild, nil
+}
+
+// MarkTools sets the Tool field of the dependencies which provide the tool packages.
+// When module paths are nested, the longest one providing the package is used.
+func MarkTools(deps []Dependency, tools []string) {
+	for _, tool := range tools {
+		best := -1
+		for i, d := range deps {
+			if tool != d.Path && !strings.HasPrefix(tool, d.Path+"/") {
+				continue
+			}
+			if best < 0 || len(d.Path) > len(deps[best].Path) {
+				best = i
+			}
+		}
+		if best >= 0 {
+			deps[best].Tool = true
+		}
+	}
+}
+
+// RenameTools changes the tool directives for packages in the oldpath module
+// to use the newpath module in the go.mod which applies to dir.
+// The new tool package paths are returned.
+func RenameTools(dir, oldpath, newpath string) ([]string, error) {
+	var renamed []string
+	err := EditModFile(dir, func(file *modfile.File) error {
+		var tools []string
+		for _, t := range file.Tool {
+			if modpath, _, ok := SplitPath(ModPrefix(oldpath), t.Path); ok && modpath == oldpath {
+				tools = append(tools, t.Path)
+			}
+		}
+		for _, path := range tools {
+			if err := file.DropTool(path); err != nil {
+				return err
+			}
+			newtool := newpath + strings.TrimPrefix(path, oldpath)
+			if err := file.AddTool(newtool); err != nil {
+				return err
+			}
+			renamed = append(renamed, newtool)
+		}
+		return nil
+	})
+	return renamed, err
+}
+
+// VendorDir returns the vendor directory used by the module which dir belongs to.
+// In a workspace, the vendor directory is next to the go.work file.
+// The second return value is false if vendoring isn't used, which is
+// the case when the vendor/modules.txt file doesn't exist and GOFLAGS
+// doesn't contain -mod=vendor.
+func VendorDir(dir string) (string, bool, error) {
+	root, err := FindWorkFile(dir)
+	if err == nil && root == "" {
+		root, err = FindModFile(dir)
+	}
+	if err != nil {
+		return "", false, err
+	}
+	vendordir := filepath.Join(filepath.Dir(root), "vendor")
+	if _, err := os.Stat(filepath.Join(vendordir, "modules.txt")); err == nil {
+		return vendordir, true, nil
+	}
+	for _, flag := range strings.Fields(goenv.Get("GOFLAGS")) {
+		if flag == "-mod=vendor" {
+			return vendordir, true, nil
+		}
+	}
+	return vendordir, false, nil
+}
+
+// VendoredModules parses the modules.txt file in the vendor directory.
+// It returns the vendored package paths keyed by module path.
+// Modules which don't provide any packages have an empty list.
+func VendoredModules(vendordir string) (map[string][]string, error) {
+	data, err := os.ReadFile(filepath.Join(vendordir, "modules.txt"))
+	if err != nil {
+		return nil, err
+	}
+	modules := map[string][]string{}
+	var current string
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+		case strings.HasPrefix(line, "## "):
+			// annotations like ## explicit
+		case strings.HasPrefix(line, "# "):
+			fields := strings.Fields(line[2:])
+			if len(fields) == 0 {
+				continue
+			}
+			current = fields[0]
+			if _, ok := modules[current]; !ok {
+				modules[current] = []string{}
+			}
+		case current != "" && strings.TrimSpace(line) != "":
+			modules[current] = append(modules[current], strings.TrimSpace(line))
+		}
+	}
+	return modules, nil
+}
+
+// ListFiles returns the Go files of the packages matching the patterns,
+// including test files. The packages are found by running go list in dir
+// with the build tags, which is a comma-separated list. The files for other
+// platforms are included, but files which can't be built with the tags on
+// any platform, such as the ones with an ignore constraint, are excluded.
+// Packages with errors are included, so imports which don't resolve
+// yet don't prevent their files from being found.
+func ListFiles(dir, tags string, patterns []string) ([]string, error) {
+	args := []string{"list", "-e", "-json=Dir,GoFiles,CgoFiles,TestGoFiles,XTestGoFiles,IgnoredGoFiles"}
+	if tags != "" {
+		args = append(args, "-tags="+tags)
+	}
+	args = append(args, "--")
+	args = append(args, patterns...)
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("go list: %s", msg)
+		}
+		return nil, fmt.Errorf("go list: %w", err)
+	}
+	tagset := map[string]bool{}
+	for _, tag := range strings.Split(tags, ",") {
+		tagset[strings.TrimSpace(tag)] = true
+	}
+	var files []string
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var pkg struct {
+			Dir            string
+			GoFiles        []string
+			CgoFiles       []string
+			TestGoFiles    []string
+			XTestGoFiles   []string
+			IgnoredGoFiles []string
+		}
+		if err := dec.Decode(&pkg); err != nil {
+			return nil, fmt.Errorf("go list: %w", err)
+		}
+		for _, names := range [][]string{pkg.GoFiles, pkg.CgoFiles, pkg.TestGoFiles, pkg.XTestGoFiles} {
+			for _, name := range names {
+				files = append(files, filepath.Join(pkg.Dir, name))
+			}
+		}
+		for _, name := range pkg.IgnoredGoFiles {
+			name = filepath.Join(pkg.Dir, name)
+			if buildable(name, tagset) {
+				files = append(files, name)
+			}
 		}
 	}
-	sort.Slice(mods, func(i, j int) bool {
-		return mods[i].Path < mods[j].Path
+	return files, nil
+}
+
+// buildable reports whether the file's build constraint can be satisfied
+// on some platform when only the tags are set. Files which can't be parsed
+// are included, so their errors are reported when they're rewritten.
+func buildable(name string, tags map[string]bool) bool {
+	f, err := parser.ParseFile(token.NewFileSet(), name, nil, parser.PackageClauseOnly|parser.ParseComments)
+	if err != nil {
+		return true
+	}
+	expr, err := BuildConstraint(f)
+	if err != nil || expr == nil {
+		return true
+	}
+	// try every combination of the platform tags used by the constraint
+	var platform []string
+	collectTags(expr, func(tag string) {
+		if isPlatformTag(tag) && !slices.Contains(platform, tag) {
+			platform = append(platform, tag)
+		}
+	})
+	if len(platform) > 16 {
+		return true
+	}
+	for set := 0; set < 1<<len(platform); set++ {
+		ok := expr.Eval(func(tag string) bool {
+			if i := slices.Index(platform, tag); i >= 0 {
+				return set&(1<<i) != 0
+			}
+			return tags[tag]
+		})
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// collectTags calls fn with every tag in the build constraint.
+func collectTags(expr constraint.Expr, fn func(tag string)) {
+	switch x := expr.(type) {
+	case *constraint.TagExpr:
+		fn(x.Tag)
+	case *constraint.NotExpr:
+		collectTags(x.X, fn)
+	case *constraint.AndExpr:
+		collectTags(x.X, fn)
+		collectTags(x.Y, fn)
+	case *constraint.OrExpr:
+		collectTags(x.X, fn)
+		collectTags(x.Y, fn)
+	}
+}
+
+// platformOS and platformArch are the GOOS and GOARCH values known to the go command.
+var (
+	platformOS   = strings.Fields("aix android darwin dragonfly freebsd hurd illumos ios js linux nacl netbsd openbsd plan9 solaris wasip1 windows zos")
+	platformArch = strings.Fields("386 amd64 amd64p32 arm armbe arm64 arm64be loong64 mips mipsle mips64 mips64le mips64p32 mips64p32le ppc ppc64 ppc64le riscv riscv64 s390 s390x sparc sparc64 wasm")
+)
+
+// isPlatformTag reports whether the build tag is set by the target platform
+// or toolchain, rather than with -tags.
+func isPlatformTag(tag string) bool {
+	switch tag {
+	case "unix", "cgo", "gc", "gccgo":
+		return true
+	}
+	return strings.HasPrefix(tag, "go1.") || slices.Contains(platformOS, tag) || slices.Contains(platformArch, tag)
+}
+
+// Graph is a module requirement graph.
+// It maps module paths to the paths of the modules they require.
+// Versions are ignored, so all the versions of a module share a node.
+type Graph map[string][]string
+
+// LoadGraph runs go mod graph in dir and parses the output.
+func LoadGraph(dir string) (Graph, error) {
+	cmd := exec.Command("go", "mod", "graph")
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("go mod graph: %s", msg)
+		}
+		return nil, fmt.Errorf("go mod graph: %w", err)
+	}
+	return ParseGraph(out)
+}
+
+// ParseGraph parses the output of go mod graph.
+func ParseGraph(data []byte) (Graph, error) {
+	g := Graph{}
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("go mod graph: line %d: expected 2 fields, got %d", i+1, len(fields))
+		}
+		from, _, _ := strings.Cut(fields[0], "@")
+		to, _, _ := strings.Cut(fields[1], "@")
+		if !slices.Contains(g[from], to) {
+			g[from] = append(g[from], to)
+		}
+	}
+	return g, nil
+}
+
+// Reaches reports whether the module path from requires the module path to,
+// directly or through other modules.
+func (g Graph) Reaches(from, to string) bool {
+	seen := map[string]bool{from: true}
+	queue := []string{from}
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+		for _, next := range g[path] {
+			if next == to {
+				return true
+			}
+			if !seen[next] {
+				seen[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	return false
+}
+
+// Via returns the paths of the direct dependencies which require the module path.
+func (g Graph) Via(deps []Dependency, path string) []string {
+	var via []string
+	for _, d := range deps {
+		if !d.Indirect && d.Path != path && g.Reaches(d.Path, path) {
+			via = append(via, d.Path)
+		}
+	}
+	return via
+}
+
+// Excluded returns the module versions excluded by the go.mod which applies to dir.
+func Excluded(dir string) ([]module.Version, error) {
+	file, err := ReadModFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	var excluded []module.Version
+	for _, e := range file.Exclude {
+		excluded = append(excluded, e.Mod)
+	}
+	return excluded, nil
+}
+
+// replacement returns the replacement for the module version.
+// Like the go command, a replacement of a specific version takes
+// precedence over one which applies to all versions.
+func replacement(file *modfile.File, m module.Version) *module.Version {
+	var found *module.Version
+	for _, r := range file.Replace {
+		if r.Old.Path != m.Path {
+			continue
+		}
+		if r.Old.Version == m.Version {
+			return &r.New
+		}
+		if r.Old.Version == "" {
+			found = &r.New
+		}
+	}
+	return found
+}
+
+// RenameReplace changes the module path on the left-hand side of the path-wide
+// replace directives for oldpath in the go.mod which applies to dir.
+// Version-specific replacements are left alone, because they only apply to a
+// version of the old path. The updated and skipped replacements are returned.
+func RenameReplace(dir, oldpath, newpath string) (renamed, skipped []*modfile.Replace, err error) {
+	err = EditModFile(dir, func(file *modfile.File) error {
+		// copy the replacements because DropReplace clears them
+		var replaces []modfile.Replace
+		for _, r := range file.Replace {
+			if r.Old.Path != oldpath {
+				continue
+			}
+			if r.Old.Version != "" {
+				skipped = append(skipped, &modfile.Replace{Old: r.Old, New: r.New})
+				continue
+			}
+			replaces = append(replaces, *r)
+		}
+		for _, r := range replaces {
+			if err := file.DropReplace(r.Old.Path, r.Old.Version); err != nil {
+				return err
+			}
+			if err := file.AddReplace(newpath, "", r.New.Path, r.New.Version); err != nil {
+				return err
+			}
+			renamed = append(renamed, &modfile.Replace{
+				Old: module.Version{Path: newpath},
+				New: r.New,
+			})
+		}
+		return nil
 	})
-	return mods, nil
+	return renamed, skipped, err
 }
@@ -1,7 +1,14 @@
 package packages
 
 import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"testing"
+
+	"golang.org/x/mod/module"
 )
 
 func TestJoinPath(t *testing.T) {
@@ -144,3 +151,407 @@ func TestSplitPath(t *testing.T) {
 		})
 	}
 }
+
+func TestGuessName(t *testing.T) {
+	tests := []struct {
+		pkgpath string
+		name    string
+	}{
+		{pkgpath: "github.com/go-redis/redis/v8", name: "redis"},
+		{pkgpath: "github.com/google/go-cmp/cmp", name: "cmp"},
+		{pkgpath: "github.com/foo/go-bar", name: "bar"},
+		{pkgpath: "gopkg.in/yaml.v3", name: "yaml"},
+		{pkgpath: "goredis.io", name: "goredis"},
+		{pkgpath: "fmt", name: "fmt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pkgpath, func(t *testing.T) {
+			if name := GuessName(tt.pkgpath); name != tt.name {
+				t.Fatalf("GuessName(%q) = %q, want %q", tt.pkgpath, name, tt.name)
+			}
+		})
+	}
+}
+
+func TestNested(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"go.mod",
+		"tools/go.mod",
+		"examples/basic/go.mod",
+		"testdata/mod/go.mod",
+		"_ignored/go.mod",
+		"pkg/pkg.go",
+	} {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dirs, err := Nested(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		dir,
+		filepath.Join(dir, "examples", "basic"),
+		filepath.Join(dir, "tools"),
+	}
+	if !reflect.DeepEqual(dirs, want) {
+		t.Fatalf("Nested() = %v, want %v", dirs, want)
+	}
+}
+
+func TestWalkModule(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"go.mod",
+		"a.go",
+		"pkg/pkg.go",
+		"vendor/example.com/a/a.go",
+		"node_modules/x/x.go",
+		".git/config",
+		".github/ci.yml",
+		"_examples/main.go",
+		"tools/go.mod",
+		"tools/tools.go",
+		"testdata/a.go",
+		"testdata/mod/go.mod",
+	} {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		opt  WalkOptions
+		want []string
+	}{
+		{
+			want: []string{"a.go", "go.mod", "pkg/pkg.go"},
+		},
+		{
+			opt:  WalkOptions{Hidden: true},
+			want: []string{".github/ci.yml", "_examples/main.go", "a.go", "go.mod", "pkg/pkg.go"},
+		},
+		{
+			opt:  WalkOptions{Testdata: true},
+			want: []string{"a.go", "go.mod", "pkg/pkg.go", "testdata/a.go", "testdata/mod/go.mod"},
+		},
+		{
+			opt:  WalkOptions{Nested: true},
+			want: []string{"a.go", "go.mod", "pkg/pkg.go", "tools/go.mod", "tools/tools.go"},
+		},
+	}
+	for _, tt := range tests {
+		var files []string
+		err := WalkModule(dir, tt.opt, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(dir, name)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(files, tt.want) {
+			t.Errorf("WalkModule(%+v) = %v, want %v", tt.opt, files, tt.want)
+		}
+	}
+}
+
+func TestDirect(t *testing.T) {
+	dir := t.TempDir()
+	gomod := `module example.com/mod
+
+go 1.21
+
+require (
+	example.com/a v1.0.0
+	example.com/b v1.2.0
+	example.com/c v1.0.0 // indirect
+)
+
+replace example.com/a => ../a
+
+replace (
+	example.com/b => example.com/fork v1.3.0
+	example.com/b v1.2.0 => example.com/fork v1.2.1
+)
+`
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(gomod), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deps, err := Direct(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Dependency{
+		{
+			Path:    "example.com/a",
+			Version: "v1.0.0",
+			Replace: &module.Version{Path: "../a"},
+		},
+		{
+			Path:    "example.com/b",
+			Version: "v1.2.0",
+			Replace: &module.Version{Path: "example.com/fork", Version: "v1.2.1"},
+		},
+	}
+	if !reflect.DeepEqual(deps, want) {
+		t.Fatalf("Direct() = %+v, want %+v", deps, want)
+	}
+	if !deps[0].IsLocal() || deps[1].IsLocal() {
+		t.Fatal("wrong IsLocal result")
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	dir := t.TempDir()
+	gomod := `module example.com/mod
+
+go 1.21
+
+require example.com/a v1.0.0
+
+exclude example.com/a v1.1.0
+
+exclude (
+	example.com/a/v2 v2.0.0
+	example.com/b v1.0.0
+)
+`
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(gomod), 0644); err != nil {
+		t.Fatal(err)
+	}
+	excluded, err := Excluded(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []module.Version{
+		{Path: "example.com/a", Version: "v1.1.0"},
+		{Path: "example.com/a/v2", Version: "v2.0.0"},
+		{Path: "example.com/b", Version: "v1.0.0"},
+	}
+	if !reflect.DeepEqual(excluded, want) {
+		t.Fatalf("Excluded() = %+v, want %+v", excluded, want)
+	}
+}
+
+func TestGraph(t *testing.T) {
+	g, err := ParseGraph([]byte(`example.com/mod example.com/a@v1.0.0
+example.com/mod example.com/b@v1.0.0
+example.com/a@v1.0.0 example.com/c@v1.0.0
+example.com/c@v1.0.0 example.com/d@v1.1.0
+example.com/b@v1.0.0 example.com/d@v1.0.0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps := []Dependency{
+		{Path: "example.com/a", Version: "v1.0.0"},
+		{Path: "example.com/b", Version: "v1.0.0"},
+		{Path: "example.com/c", Version: "v1.0.0", Indirect: true},
+		{Path: "example.com/d", Version: "v1.1.0", Indirect: true},
+	}
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{path: "example.com/c", want: []string{"example.com/a"}},
+		{path: "example.com/d", want: []string{"example.com/a", "example.com/b"}},
+		{path: "example.com/e", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if via := g.Via(deps, tt.path); !reflect.DeepEqual(via, tt.want) {
+				t.Fatalf("Via(%q) = %v, want %v", tt.path, via, tt.want)
+			}
+		})
+	}
+	if _, err := ParseGraph([]byte("example.com/mod\n")); err == nil {
+		t.Fatal("expected error for malformed line")
+	}
+}
+
+func TestTools(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod": `module example.com/mod
+
+go 1.24
+
+tool example.com/a/cmd/a
+
+require (
+	example.com/a v1.0.0
+	example.com/b v1.0.0
+	example.com/b/sub v1.0.0
+	example.com/c v1.0.0
+)
+`,
+		"tools/tools.go": `//go:build tools
+
+package tools
+
+import (
+	_ "example.com/b/sub/cmd/b"
+	c "example.com/c"
+)
+`,
+		"tools/legacy.go":  "// +build tools\n\npackage tools\n\nimport _ \"example.com/d/cmd/d\"\n",
+		"tools/ignored.go": "//go:build ignore\n// +build tools\n\npackage tools\n\nimport _ \"example.com/e/cmd/e\"\n",
+		"main.go": `package main
+
+import _ "example.com/c"
+`,
+		"nested/go.mod":   "module example.com/mod/nested\n",
+		"nested/tools.go": "//go:build tools\n\npackage tools\n\nimport _ \"example.com/c\"\n",
+	}
+	for name, data := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tools, err := Tools(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"example.com/a/cmd/a", "example.com/d/cmd/d", "example.com/b/sub/cmd/b"}
+	if !reflect.DeepEqual(tools, want) {
+		t.Fatalf("Tools() = %v, want %v", tools, want)
+	}
+	deps, err := Requirements(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	MarkTools(deps, tools)
+	var marked []string
+	for _, d := range deps {
+		if d.Tool {
+			marked = append(marked, d.Path)
+		}
+	}
+	if want := []string{"example.com/a", "example.com/b/sub"}; !reflect.DeepEqual(marked, want) {
+		t.Fatalf("MarkTools() marked %v, want %v", marked, want)
+	}
+	renamed, err := RenameTools(dir, "example.com/a", "example.com/a/v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"example.com/a/v2/cmd/a"}; !reflect.DeepEqual(renamed, want) {
+		t.Fatalf("RenameTools() = %v, want %v", renamed, want)
+	}
+}
+
+func TestVendoredModules(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod": "module example.com/mod\n\ngo 1.21\n",
+		"vendor/modules.txt": `# example.com/a v1.0.0
+## explicit; go 1.19
+example.com/a
+example.com/a/sub
+# example.com/b/v2 v2.1.0
+## explicit
+# example.com/c v1.0.0 => ./c
+example.com/c
+`,
+	}
+	for name, data := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("GOWORK", "off")
+	vendordir, ok, err := VendorDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || vendordir != filepath.Join(dir, "vendor") {
+		t.Fatalf("VendorDir() = %q, %v", vendordir, ok)
+	}
+	modules, err := VendoredModules(vendordir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"example.com/a":    {"example.com/a", "example.com/a/sub"},
+		"example.com/b/v2": {},
+		"example.com/c":    {"example.com/c"},
+	}
+	if !reflect.DeepEqual(modules, want) {
+		t.Fatalf("VendoredModules() = %v, want %v", modules, want)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.mod":             "module example.com/mod\n\ngo 1.21\n",
+		"a/a_linux.go":       "package a\n",
+		"a/a_windows.go":     "package a\n",
+		"a/a_test.go":        "package a\n",
+		"a/integration.go":   "//go:build integration\n\npackage a\n",
+		"a/a_other.go":       "//go:build (darwin || windows) && !integration\n\npackage a\n",
+		"a/gen.go":           "//go:build ignore\n\npackage main\n",
+		"a/testdata/skip.go": "package skip\n",
+		"b/b.go":             "package b\n",
+	}
+	for name, data := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("GOWORK", "off")
+	tests := []struct {
+		tags string
+		want []string
+	}{
+		{
+			want: []string{"a_linux.go", "a_test.go", "a_other.go", "a_windows.go"},
+		},
+		{
+			tags: "integration",
+			want: []string{"a_linux.go", "a_test.go", "a_windows.go", "integration.go"},
+		},
+	}
+	for _, tt := range tests {
+		names, err := ListFiles(dir, tt.tags, []string{"./a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(names)
+		var want []string
+		for _, name := range tt.want {
+			want = append(want, filepath.Join(dir, "a", name))
+		}
+		sort.Strings(want)
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("ListFiles(%q) = %v, want %v", tt.tags, names, want)
+		}
+	}
+}
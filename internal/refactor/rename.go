@@ -0,0 +1,236 @@
+// Package refactor implements type-aware source code changes.
+package refactor
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"os"
+	"sort"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/icholy/gomajor/internal/importpaths"
+)
+
+// Load type-checks the packages matching the patterns in dir, including tests.
+// Packages with type errors are returned along with the partial type information.
+func Load(dir string, patterns ...string) ([]*packages.Package, error) {
+	cfg := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedSyntax |
+			packages.NeedTypes | packages.NeedTypesInfo | packages.NeedImports | packages.NeedDeps,
+		Dir:   dir,
+		Tests: true,
+	}
+	return packages.Load(cfg, patterns...)
+}
+
+// RenamePackageOptions specifies a package to rename.
+type RenamePackageOptions struct {
+	// PkgPath is the import path of the package being renamed.
+	PkgPath string
+	// NewName is the new package name.
+	NewName string
+}
+
+// RenamePackage records the changes to the package clauses of the package and
+// its external test package in the editor. Selector expressions in the other
+// packages in dir which refer to the package through an unnamed import are
+// updated to use the new name. Nothing is recorded if the package already has
+// the new name, or if it's a command (package main). The packages in dir must
+// type-check, so the uses of the package can be found.
+func RenamePackage(ed *Editor, dir string, opt RenamePackageOptions) error {
+	pkgs, err := Load(dir, "./...")
+	if err != nil {
+		return err
+	}
+	if err := loadErrors(pkgs); err != nil {
+		return err
+	}
+	for _, pkg := range pkgs {
+		if pkg.PkgPath == opt.PkgPath && (pkg.Name == "main" || pkg.Name == opt.NewName) {
+			return nil
+		}
+	}
+	var errs []error
+	for _, pkg := range pkgs {
+		for _, f := range pkg.Syntax {
+			switch {
+			case pkg.PkgPath == opt.PkgPath:
+				if f.Name.Name == opt.NewName {
+					continue
+				}
+				ed.Replace(pkg.Fset, f.Name, opt.NewName)
+			case pkg.PkgPath == opt.PkgPath+"_test":
+				ed.Replace(pkg.Fset, f.Name, opt.NewName+"_test")
+				fallthrough
+			default:
+				if err := renameSelectors(ed, pkg, f, opt); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// loadErrors returns the errors of the loaded packages, or nil if there aren't any.
+// Test variants repeat the errors of the packages they include, so duplicates are removed.
+func loadErrors(pkgs []*packages.Package) error {
+	var errs []error
+	seen := map[string]bool{}
+	for _, pkg := range pkgs {
+		for _, err := range pkg.Errors {
+			if msg := err.Error(); !seen[msg] {
+				seen[msg] = true
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// renameSelectors updates references to the package through unnamed imports in the file.
+func renameSelectors(ed *Editor, pkg *packages.Package, f *ast.File, opt RenamePackageOptions) error {
+	for _, spec := range f.Imports {
+		if spec.Name != nil {
+			continue
+		}
+		obj, ok := pkg.TypesInfo.Implicits[spec].(*types.PkgName)
+		if !ok || obj.Imported().Path() != opt.PkgPath || obj.Name() == opt.NewName {
+			continue
+		}
+		// make sure the new name doesn't conflict with anything in the file
+		if conflict := fileScopeLookup(pkg, f, opt.NewName); conflict != nil {
+			return fmt.Errorf("%s: cannot rename %s to %s: conflicts with %s",
+				pkg.Fset.Position(spec.Pos()), obj.Name(), opt.NewName, pkg.Fset.Position(conflict.Pos()))
+		}
+		var uses []*ast.Ident
+		for id, use := range pkg.TypesInfo.Uses {
+			if use == obj {
+				uses = append(uses, id)
+			}
+		}
+		// the new name may be shadowed where the package is used
+		sort.Slice(uses, func(i, j int) bool { return uses[i].Pos() < uses[j].Pos() })
+		for _, id := range uses {
+			if conflict := scopeLookup(pkg, id.Pos(), opt.NewName); conflict != nil {
+				return fmt.Errorf("%s: cannot rename %s to %s: conflicts with %s",
+					pkg.Fset.Position(id.Pos()), obj.Name(), opt.NewName, pkg.Fset.Position(conflict.Pos()))
+			}
+		}
+		for _, id := range uses {
+			ed.Replace(pkg.Fset, id, opt.NewName)
+		}
+	}
+	return nil
+}
+
+// fileScopeLookup finds an object named name in the file or package scopes.
+func fileScopeLookup(pkg *packages.Package, f *ast.File, name string) types.Object {
+	if scope := pkg.TypesInfo.Scopes[f]; scope != nil {
+		if obj := scope.Lookup(name); obj != nil {
+			return obj
+		}
+	}
+	return pkg.Types.Scope().Lookup(name)
+}
+
+// scopeLookup finds an object named name which is visible at the position,
+// ignoring the universe scope.
+func scopeLookup(pkg *packages.Package, pos token.Pos, name string) types.Object {
+	scope := pkg.Types.Scope().Innermost(pos)
+	if scope == nil {
+		return nil
+	}
+	if _, obj := scope.LookupParent(name, pos); obj != nil && obj.Parent() != types.Universe {
+		return obj
+	}
+	return nil
+}
+
+// Editor collects text replacements across files.
+// The same file may be seen multiple times when tests are loaded,
+// so replacements are keyed by position.
+type Editor struct {
+	files map[string]map[int]replacement
+}
+
+// replacement replaces the text at a position.
+type replacement struct {
+	pos      token.Position
+	old, new string
+}
+
+// Replace records a replacement of the identifier.
+func (e *Editor) Replace(fset *token.FileSet, id *ast.Ident, name string) {
+	e.ReplaceText(fset.PositionFor(id.Pos(), false), id.Name, name)
+}
+
+// ReplaceText records a replacement of the old text at the position.
+// An empty old text inserts the new text.
+func (e *Editor) ReplaceText(pos token.Position, old, new string) {
+	if e.files == nil {
+		e.files = map[string]map[int]replacement{}
+	}
+	if e.files[pos.Filename] == nil {
+		e.files[pos.Filename] = map[int]replacement{}
+	}
+	if _, ok := e.files[pos.Filename][pos.Offset]; ok {
+		return
+	}
+	e.files[pos.Filename][pos.Offset] = replacement{pos: pos, old: old, new: new}
+}
+
+// Write applies the replacements to the files and reports them in order.
+// All files are read and checked before any are written, and the files
+// are restored if any write fails. Replacements are reported once every
+// file has been written.
+func (e *Editor) Write(report func(pos token.Position, old, new string)) error {
+	names := make([]string, 0, len(e.files))
+	for name := range e.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var changes []importpaths.FileChange
+	var done []replacement
+	for _, name := range names {
+		src, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		offsets := make([]int, 0, len(e.files[name]))
+		for off := range e.files[name] {
+			offsets = append(offsets, off)
+		}
+		sort.Ints(offsets)
+		var out []byte
+		var last int
+		for _, off := range offsets {
+			r := e.files[name][off]
+			if off+len(r.old) > len(src) || string(src[off:off+len(r.old)]) != r.old {
+				return fmt.Errorf("%s: file changed while editing", name)
+			}
+			out = append(out, src[last:off]...)
+			out = append(out, r.new...)
+			last = off + len(r.old)
+			done = append(done, r)
+		}
+		changes = append(changes, importpaths.FileChange{
+			Name: name,
+			Orig: src,
+			Data: append(out, src[last:]...),
+		})
+	}
+	if err := importpaths.WriteFiles(changes); err != nil {
+		return err
+	}
+	if report != nil {
+		for _, r := range done {
+			report(r.pos, r.old, r.new)
+		}
+	}
+	return nil
+}
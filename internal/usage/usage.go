@@ -0,0 +1,285 @@
+// Package usage reports which parts of a dependency a project uses.
+package usage
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+	"strconv"
+
+	"golang.org/x/tools/go/packages"
+
+	"github.com/icholy/gomajor/internal/importpaths"
+	modpkgs "github.com/icholy/gomajor/internal/packages"
+	"github.com/icholy/gomajor/internal/refactor"
+)
+
+// Options specifies the module whose usage is reported.
+type Options struct {
+	// ModPath is the module path. If it has a major version suffix, only that
+	// major version is reported. Otherwise, every major version is reported.
+	ModPath string
+	// Exact limits the report to the major version of ModPath,
+	// even if it doesn't have a major version suffix.
+	Exact bool
+	// Patterns are the package patterns to load. The default is ./...
+	Patterns []string
+}
+
+// Importer is a package which uses the module.
+type Importer struct {
+	PkgPath string
+	Imports []*Import
+}
+
+// Import is a package of the module which is imported or whose
+// exported identifiers are referenced.
+type Import struct {
+	Path string
+	// Positions are the import declarations.
+	Positions []token.Position
+	Symbols   []*Symbol
+}
+
+// Symbol is a referenced exported identifier.
+type Symbol struct {
+	// Name is the identifier, which is qualified by the type name
+	// for methods and fields. For example, Client.Get.
+	Name      string
+	Positions []token.Position
+}
+
+// Find type-checks the packages in dir, including tests, and returns the ones
+// which use the module sorted by package path.
+func Find(dir string, opt Options) ([]*Importer, error) {
+	patterns := opt.Patterns
+	if len(patterns) == 0 {
+		patterns = []string{"./..."}
+	}
+	pkgs, err := refactor.Load(dir, patterns...)
+	if err != nil {
+		return nil, err
+	}
+	return Collect(pkgs, opt), nil
+}
+
+// Collect returns the packages which use the module from the loaded packages,
+// sorted by package path. The patterns in opt are ignored.
+func Collect(pkgs []*packages.Package, opt Options) []*Importer {
+	f := NewFinder(opt)
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Syntax {
+			f.File(pkg.PkgPath, pkg.Fset, pkg.TypesInfo, file)
+		}
+	}
+	return f.Importers()
+}
+
+// Finder collects the usage of a module from type-checked files.
+type Finder struct {
+	modpath string
+	exact   bool
+	matcher importpaths.ModuleMatcher
+	// importers are keyed by package path
+	importers map[string]*importer
+	// seen contains the recorded positions because the files of a
+	// package are type-checked again for its tests
+	seen map[token.Position]bool
+	// owners maps struct fields to the names of the types which declare them
+	owners map[*types.Var]string
+}
+
+// importer is an Importer which is being collected.
+type importer struct {
+	imports map[string]*Import
+	symbols map[*Import]map[string]*Symbol
+}
+
+// NewFinder returns a Finder for the module. The patterns in opt are ignored.
+func NewFinder(opt Options) *Finder {
+	major, _ := modpkgs.ModMajor(opt.ModPath)
+	return &Finder{
+		modpath:   opt.ModPath,
+		exact:     opt.Exact || major != "",
+		matcher:   importpaths.ModuleMatcher{Prefix: modpkgs.ModPrefix(opt.ModPath)},
+		importers: map[string]*importer{},
+		seen:      map[token.Position]bool{},
+		owners:    map[*types.Var]string{},
+	}
+}
+
+// Match reports whether the package path belongs to the module.
+func (f *Finder) Match(path string) bool {
+	modpath, _, ok := f.matcher.Match(path)
+	return ok && (!f.exact || modpath == f.modpath)
+}
+
+// File records the imports of the module and the references to its exported
+// identifiers in a file of the package.
+func (f *Finder) File(pkgpath string, fset *token.FileSet, info *types.Info, file *ast.File) {
+	for _, spec := range file.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil || !f.Match(path) {
+			continue
+		}
+		imp := f.lookup(pkgpath, path)
+		if pos := fset.Position(spec.Pos()); f.record(pos) {
+			imp.Positions = append(imp.Positions, pos)
+		}
+	}
+	ast.Inspect(file, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok {
+			return true
+		}
+		obj := info.Uses[id]
+		if obj == nil || obj.Pkg() == nil || !obj.Exported() || !f.Match(obj.Pkg().Path()) {
+			return true
+		}
+		if _, ok := obj.(*types.PkgName); ok {
+			return true
+		}
+		pos := fset.Position(id.Pos())
+		if !f.record(pos) {
+			return true
+		}
+		sym := f.symbol(pkgpath, obj.Pkg().Path(), f.Name(obj))
+		sym.Positions = append(sym.Positions, pos)
+		return true
+	})
+}
+
+// Name returns the name of the exported identifier,
+// qualified by the type name for methods and fields.
+func (f *Finder) Name(obj types.Object) string {
+	switch obj := obj.(type) {
+	case *types.Func:
+		if recv := obj.Signature().Recv(); recv != nil {
+			if name := typeName(recv.Type()); name != "" {
+				return name + "." + obj.Name()
+			}
+		}
+	case *types.Var:
+		if obj.IsField() {
+			if owner := f.owner(obj); owner != "" {
+				return owner + "." + obj.Name()
+			}
+		}
+	}
+	return obj.Name()
+}
+
+// Importers returns the recorded importers sorted by package path.
+// The imports, symbols, and positions are sorted too.
+func (f *Finder) Importers() []*Importer {
+	var importers []*Importer
+	for pkgpath, imp := range f.importers {
+		importer := &Importer{PkgPath: pkgpath}
+		for _, i := range imp.imports {
+			for _, sym := range imp.symbols[i] {
+				sortPositions(sym.Positions)
+				i.Symbols = append(i.Symbols, sym)
+			}
+			sort.Slice(i.Symbols, func(a, b int) bool {
+				return i.Symbols[a].Name < i.Symbols[b].Name
+			})
+			sortPositions(i.Positions)
+			importer.Imports = append(importer.Imports, i)
+		}
+		sort.Slice(importer.Imports, func(a, b int) bool {
+			return importer.Imports[a].Path < importer.Imports[b].Path
+		})
+		importers = append(importers, importer)
+	}
+	sort.Slice(importers, func(a, b int) bool {
+		return importers[a].PkgPath < importers[b].PkgPath
+	})
+	return importers
+}
+
+// record reports whether the position hasn't been recorded before.
+func (f *Finder) record(pos token.Position) bool {
+	if f.seen[pos] {
+		return false
+	}
+	f.seen[pos] = true
+	return true
+}
+
+// lookup returns the import of the path by the package, creating it if needed.
+func (f *Finder) lookup(pkgpath, path string) *Import {
+	imp, ok := f.importers[pkgpath]
+	if !ok {
+		imp = &importer{
+			imports: map[string]*Import{},
+			symbols: map[*Import]map[string]*Symbol{},
+		}
+		f.importers[pkgpath] = imp
+	}
+	i, ok := imp.imports[path]
+	if !ok {
+		i = &Import{Path: path}
+		imp.imports[path] = i
+		imp.symbols[i] = map[string]*Symbol{}
+	}
+	return i
+}
+
+// symbol returns the named symbol of the import, creating it if needed.
+func (f *Finder) symbol(pkgpath, path, name string) *Symbol {
+	i := f.lookup(pkgpath, path)
+	symbols := f.importers[pkgpath].symbols[i]
+	sym, ok := symbols[name]
+	if !ok {
+		sym = &Symbol{Name: name}
+		symbols[name] = sym
+	}
+	return sym
+}
+
+// owner returns the name of the package-level type which declares the field.
+// It's empty if the field belongs to an anonymous struct.
+func (f *Finder) owner(field *types.Var) string {
+	field = field.Origin()
+	if name, ok := f.owners[field]; ok {
+		return name
+	}
+	scope := field.Pkg().Scope()
+	for _, name := range scope.Names() {
+		tn, ok := scope.Lookup(name).(*types.TypeName)
+		if !ok {
+			continue
+		}
+		if st, ok := tn.Type().Underlying().(*types.Struct); ok {
+			for i := range st.NumFields() {
+				f.owners[st.Field(i)] = name
+			}
+		}
+	}
+	if _, ok := f.owners[field]; !ok {
+		f.owners[field] = ""
+	}
+	return f.owners[field]
+}
+
+// typeName returns the name of the named type, or the type pointed to.
+func typeName(t types.Type) string {
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	if named, ok := types.Unalias(t).(*types.Named); ok {
+		return named.Obj().Name()
+	}
+	return ""
+}
+
+// sortPositions sorts the positions by file and offset.
+func sortPositions(positions []token.Position) {
+	sort.Slice(positions, func(i, j int) bool {
+		if positions[i].Filename != positions[j].Filename {
+			return positions[i].Filename < positions[j].Filename
+		}
+		return positions[i].Offset < positions[j].Offset
+	})
+}
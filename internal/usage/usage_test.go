@@ -0,0 +1,30 @@
+package usage
+
+import "testing"
+
+func TestFinderMatch(t *testing.T) {
+	tests := []struct {
+		modpath string
+		exact   bool
+		path    string
+		match   bool
+	}{
+		{modpath: "github.com/go-redis/redis", path: "github.com/go-redis/redis", match: true},
+		{modpath: "github.com/go-redis/redis", path: "github.com/go-redis/redis/v8/internal", match: true},
+		{modpath: "github.com/go-redis/redis/v8", path: "github.com/go-redis/redis/v8/internal", match: true},
+		{modpath: "github.com/go-redis/redis/v8", path: "github.com/go-redis/redis/v9", match: false},
+		{modpath: "github.com/go-redis/redis/v8", path: "github.com/go-redis/redis", match: false},
+		{modpath: "github.com/go-redis/redis", path: "github.com/go-redis/redismock", match: false},
+		{modpath: "github.com/go-redis/redis", exact: true, path: "github.com/go-redis/redis/internal", match: true},
+		{modpath: "github.com/go-redis/redis", exact: true, path: "github.com/go-redis/redis/v8", match: false},
+		{modpath: "gopkg.in/yaml.v3", path: "gopkg.in/yaml.v3", match: true},
+		{modpath: "gopkg.in/yaml.v3", path: "gopkg.in/yaml.v2", match: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.modpath+" "+tt.path, func(t *testing.T) {
+			if match := NewFinder(Options{ModPath: tt.modpath, Exact: tt.exact}).Match(tt.path); match != tt.match {
+				t.Fatalf("Match(%q) = %v, want %v", tt.path, match, tt.match)
+			}
+		})
+	}
+}
@@ -2,21 +2,34 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"go/token"
+	"maps"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"regexp"
 	"runtime/debug"
+	"slices"
+	"sort"
+	"strings"
 
 	"golang.org/x/mod/modfile"
 	"golang.org/x/mod/module"
 	"golang.org/x/mod/semver"
+	gopackages "golang.org/x/tools/go/packages"
 
+	"github.com/icholy/gomajor/internal/apidiff"
+	"github.com/icholy/gomajor/internal/impact"
 	"github.com/icholy/gomajor/internal/importpaths"
+	"github.com/icholy/gomajor/internal/migrate"
 	"github.com/icholy/gomajor/internal/modproxy"
 	"github.com/icholy/gomajor/internal/packages"
+	"github.com/icholy/gomajor/internal/refactor"
+	"github.com/icholy/gomajor/internal/usage"
 )
 
 var help = `
@@ -31,6 +44,8 @@ The commands are:
     get     upgrade to a major version
     list    list available updates
     path    modify the module path
+    usage   show which parts of a module are used
+    diff    compare the API of two module versions
     version print the gomajor version
     help    show this help text
 `
@@ -53,6 +68,14 @@ func main() {
 		if err := pathcmd(flag.Args()[1:]); err != nil {
 			fmt.Fprintln(os.Stderr, err.Error())
 		}
+	case "usage":
+		if err := usagecmd(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+		}
+	case "diff":
+		if err := diffcmd(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+		}
 	case "version":
 		if err := versioncmd(); err != nil {
 			fmt.Fprintln(os.Stderr, err.Error())
@@ -67,19 +90,36 @@ func main() {
 
 func listcmd(args []string) error {
 	var dir string
-	var pre, cached, major, jsonfmt bool
+	var pre, cached, major, jsonfmt, replaced, indirect, all, showimpact bool
 	fset := flag.NewFlagSet("list", flag.ExitOnError)
 	fset.BoolVar(&pre, "pre", false, "allow non-v0 prerelease versions")
 	fset.StringVar(&dir, "dir", ".", "working directory")
 	fset.BoolVar(&cached, "cached", true, "only fetch cached content from the module proxy")
 	fset.BoolVar(&major, "major", false, "only show newer major versions")
 	fset.BoolVar(&jsonfmt, "json", false, "output json format")
+	fset.BoolVar(&replaced, "replaced", false, "include modules replaced by local directories")
+	fset.BoolVar(&indirect, "indirect", false, "only show indirect dependencies")
+	fset.BoolVar(&all, "all", false, "show direct and indirect dependencies")
+	fset.BoolVar(&showimpact, "impact", false, "show the uses of APIs broken by newer major versions, easiest upgrades first")
 	fset.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage: gomajor list [modules]")
 		fset.PrintDefaults()
 	}
 	fset.Parse(args)
-	modules, err := packages.Direct(dir)
+	modules, err := dependencies(dir, indirect || all)
+	if err != nil {
+		return err
+	}
+	if indirect && !all {
+		var filtered []packages.Dependency
+		for _, m := range modules {
+			if m.Indirect {
+				filtered = append(filtered, m)
+			}
+		}
+		modules = filtered
+	}
+	excluded, err := exclusions(dir)
 	if err != nil {
 		return err
 	}
@@ -88,7 +128,7 @@ func listcmd(args []string) error {
 		for _, a := range fset.Args() {
 			prefixes[packages.ModPrefix(a)] = true
 		}
-		var filtered []module.Version
+		var filtered []packages.Dependency
 		for _, m := range modules {
 			if prefixes[packages.ModPrefix(m.Path)] {
 				filtered = append(filtered, m)
@@ -96,37 +136,154 @@ func listcmd(args []string) error {
 		}
 		modules = filtered
 	}
+	if !replaced {
+		var filtered []packages.Dependency
+		for _, m := range modules {
+			if !m.IsLocal() {
+				filtered = append(filtered, m)
+			}
+		}
+		modules = filtered
+	}
+	var pkgs []*gopackages.Package
+	if showimpact {
+		pkgs, err = refactor.Load(dir, "./...")
+		if err != nil {
+			return err
+		}
+	}
+	show := func(u modproxy.Update, r *impact.Report) {
+		if jsonfmt {
+			data, _ := json.Marshal(u)
+			if r != nil {
+				data, _ = withImpact(data, r)
+			}
+			fmt.Println(string(data))
+			return
+		}
+		var notes string
+		if indirect || all {
+			switch {
+			case !u.Module.Indirect:
+				notes += " (direct)"
+			case len(u.Module.Via) > 0:
+				notes += fmt.Sprintf(" (indirect via %s)", strings.Join(u.Module.Via, ", "))
+			default:
+				notes += " (indirect)"
+			}
+		}
+		if u.Module.Tool {
+			notes += " (tool)"
+		}
+		if r := u.Module.Replace; r != nil {
+			notes += fmt.Sprintf(" (replaced by %s)", strings.TrimSpace(r.Path+" "+r.Version))
+		}
+		if e := u.Excluded; e != nil {
+			notes += fmt.Sprintf(" (%s@%s excluded)", e.Path, e.Version)
+		}
+		if r != nil {
+			notes += fmt.Sprintf(" (impact %d: sites %d, changes %d)", r.Score, len(r.Sites), r.Changes)
+		}
+		fmt.Printf("%s: %s [latest %v]%s\n", u.Module.Path, u.Module.Version, u.Latest.Version, notes)
+		if r != nil {
+			for _, site := range r.Sites {
+				change := site.Change.String()
+				if site.Name == "" {
+					change = "import " + site.Path + ": " + change
+				} else if site.Name != site.Change.Name {
+					change = site.Name + ": " + change
+				}
+				fmt.Printf("\t%s %s\n", relpos(site.Pos), change)
+			}
+		}
+	}
+	var updates []modproxy.Update
 	modproxy.Updates(modproxy.UpdateOptions{
-		Pre:     pre,
-		Major:   major,
-		Cached:  cached,
-		Modules: modules,
+		Pre:      pre,
+		Major:    major,
+		Cached:   cached,
+		Modules:  modules,
+		Excluded: excluded,
 		OnUpdate: func(u modproxy.Update) {
-			if jsonfmt {
-				data, _ := json.Marshal(u)
-				fmt.Println(string(data))
+			if u.Err != nil && !jsonfmt {
+				fmt.Fprintf(os.Stderr, "%s: failed: %v\n", u.Module.Path, u.Err)
 				return
 			}
-			if u.Err != nil {
-				fmt.Fprintf(os.Stderr, "%s: failed: %v\n", u.Module.Path, u.Err)
-			} else {
-				fmt.Printf("%s: %s [latest %v]\n", u.Module.Path, u.Module.Version, u.Latest.Version)
+			if showimpact && u.Err == nil {
+				updates = append(updates, u)
+				return
 			}
+			show(u, nil)
 		},
 	})
+	if !showimpact {
+		return nil
+	}
+	// show the easiest upgrades first
+	reports := map[string]*impact.Report{}
+	for _, u := range updates {
+		if u.Latest.Path == u.Module.Path {
+			continue
+		}
+		old := module.Version{Path: u.Module.Path, Version: u.Module.Version}
+		r, err := impact.Upgrade(pkgs, old, u.Latest, cached)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: impact: %v\n", u.Module.Path, err)
+			continue
+		}
+		reports[u.Module.Path] = r
+	}
+	sort.SliceStable(updates, func(i, j int) bool {
+		return score(reports[updates[i].Module.Path]) < score(reports[updates[j].Module.Path])
+	})
+	for _, u := range updates {
+		show(u, reports[u.Module.Path])
+	}
 	return nil
 }
 
+// score returns the score of the impact report, which is zero if there isn't one.
+func score(r *impact.Report) int {
+	if r == nil {
+		return 0
+	}
+	return r.Score
+}
+
+// withImpact adds the impact report to the json encoded update.
+func withImpact(data []byte, r *impact.Report) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	report, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	fields["Impact"] = report
+	return json.Marshal(fields)
+}
+
 func getcmd(args []string) error {
 	var rewrite regexp.Regexp
-	var dir string
-	var pre, cached, major bool
+	var dir, local, text, pkgs, tags, mapfile, tmplfiles string
+	var pre, cached, major, nested, proto, testdata, tolerant bool
 	fset := flag.NewFlagSet("get", flag.ExitOnError)
 	fset.BoolVar(&pre, "pre", false, "allow non-v0 prerelease versions")
 	fset.BoolVar(&major, "major", false, "only get newer major versions")
 	fset.StringVar(&dir, "dir", ".", "working directory")
 	fset.BoolVar(&cached, "cached", true, "only fetch cached content from the module proxy")
 	fset.TextVar(&rewrite, "rewrite", regexp.MustCompile(".*"), "only rewrite imports matching this regex")
+	fset.StringVar(&local, "local", "", "put imports beginning with this string after 3rd-party packages; comma-separated list")
+	fset.BoolVar(&nested, "nested", false, "also upgrade nested modules which require the module")
+	fset.BoolVar(&proto, "proto", false, "also rewrite go_package options in .proto files")
+	fset.StringVar(&text, "text", "", "also rewrite package paths in non-Go files matching these globs; comma-separated list")
+	fset.BoolVar(&testdata, "testdata", false, "also rewrite testdata directories, including txtar archives")
+	fset.BoolVar(&tolerant, "e", false, "report files which can't be parsed instead of stopping")
+	fset.StringVar(&pkgs, "pkgs", "", "only rewrite the Go files of packages matching these patterns; comma-separated list")
+	fset.StringVar(&tags, "tags", "", "build tags used to resolve -pkgs; comma-separated list")
+	fset.StringVar(&mapfile, "map", "", "file with package and identifier renames to apply after rewriting imports")
+	fset.StringVar(&tmplfiles, "template", "", "before and after template files to apply after rewriting imports; comma-separated list")
 	fset.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage: gomajor get <pathspec>")
 		fset.PrintDefaults()
@@ -135,43 +292,99 @@ func getcmd(args []string) error {
 	if fset.NArg() != 1 {
 		return fmt.Errorf("missing package spec")
 	}
+	files, err := scope(dir, pkgs, tags)
+	if err != nil {
+		return err
+	}
+	var mapping *migrate.Mapping
+	if mapfile != "" {
+		mapping, err = migrate.ReadMapping(mapfile)
+		if err != nil {
+			return err
+		}
+	}
+	var templates []*migrate.Template
+	for _, name := range commaList(tmplfiles) {
+		t, err := migrate.ReadTemplate(name)
+		if err != nil {
+			return err
+		}
+		templates = append(templates, t)
+	}
+	// the rewrite options which are the same for every module
+	ropt := importpaths.RewriteModuleOptions{
+		CommonOptions: importpaths.CommonOptions{
+			LocalPrefix: local,
+			Proto:       proto,
+			Text:        commaList(text),
+			Testdata:    testdata,
+			Tolerant:    tolerant,
+			Files:       files,
+		},
+		OnRewrite: func(pos token.Position, oldpath, newpath string) error {
+			if !rewrite.MatchString(oldpath) {
+				return importpaths.ErrSkip
+			}
+			fmt.Printf("%s %s\n", relpos(pos), newpath)
+			return nil
+		},
+	}
 	// check for "all" special case
 	if fset.Arg(0) == "all" {
-		modules, err := packages.Direct(dir)
+		modules, err := direct(dir)
+		if err != nil {
+			return err
+		}
+		excluded, err := exclusions(dir)
 		if err != nil {
 			return err
 		}
 		modproxy.Updates(modproxy.UpdateOptions{
-			Pre:     pre,
-			Major:   major,
-			Cached:  cached,
-			Modules: modules,
+			Pre:      pre,
+			Major:    major,
+			Cached:   cached,
+			Modules:  modules,
+			Excluded: excluded,
 			OnUpdate: func(u modproxy.Update) {
 				if u.Err != nil {
 					fmt.Fprintf(os.Stderr, "%s: failed: %v\n", u.Module.Path, u.Err)
 					return
 				}
-				// go get
-				spec := u.Latest.Path + "@" + u.Latest.Version
-				fmt.Println("go get", spec)
-				cmd := exec.Command("go", "get", spec)
-				cmd.Dir = dir
-				cmd.Stdout = os.Stdout
-				cmd.Stderr = os.Stderr
-				if err := cmd.Run(); err != nil {
-					return
+				if e := u.Excluded; e != nil {
+					fmt.Printf("skipping excluded %s@%s\n", e.Path, e.Version)
 				}
-				// rewrite import paths
-				err := importpaths.RewriteModule(dir, importpaths.RewriteModuleOptions{
-					Prefix:     packages.ModPrefix(u.Module.Path),
-					NewVersion: u.Latest.Version,
-					OnRewrite: func(pos token.Position, _, newpath string) error {
-						fmt.Printf("%s %s\n", pos, newpath)
-						return nil
-					},
-				})
+				modprefix := packages.ModPrefix(u.Module.Path)
+				dirs, err := moduledirs(dir, modprefix, nested)
 				if err != nil {
-					fmt.Fprintf(os.Stderr, "rewrite: %v", err)
+					fmt.Fprintf(os.Stderr, "%s: failed: %v\n", u.Module.Path, err)
+					return
+				}
+				newnames := pkgnames(u.Latest, cached)
+				var summary []string
+				for _, dir := range dirs {
+					up := upgrade{
+						dir:       dir,
+						spec:      u.Latest.Path + "@" + u.Latest.Version,
+						newpath:   u.Latest.Path,
+						rewrite:   ropt,
+						mapping:   mapping,
+						templates: templates,
+					}
+					up.rewrite.Prefix = modprefix
+					up.rewrite.NewVersion = u.Latest.Version
+					up.rewrite.NewPkgNames = newnames
+					if old, ok := required(dir, modprefix); ok {
+						up.oldpath = old.Path
+						up.rewrite.OldPkgNames = requirednames(dir, modprefix, cached)
+					}
+					n, err := getmodule(up)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "%s: failed: %v\n", u.Module.Path, err)
+					}
+					summary = append(summary, summarize(dir, n, err))
+				}
+				if len(dirs) > 1 {
+					fmt.Printf("%s:\n%s", u.Latest.Path, strings.Join(summary, ""))
 				}
 			},
 		})
@@ -185,16 +398,31 @@ func getcmd(args []string) error {
 	}
 	modprefix := packages.ModPrefix(mod.Path)
 	_, pkgdir, _ := packages.SplitPath(modprefix, pkgpath)
+	excluded, err := exclusions(dir)
+	if err != nil {
+		return err
+	}
 	// figure out what version to get
 	var version string
 	switch query {
 	case "":
 		version = mod.MaxVersion("", pre)
+		if excluded.Includes(mod.Path, version) {
+			fmt.Printf("skipping excluded %s@%s\n", mod.Path, version)
+			version = mod.Exclude(excluded).MaxVersion("", pre)
+			if version == "" {
+				return fmt.Errorf("%s: all versions are excluded", mod.Path)
+			}
+			query = version
+		}
 	case "latest":
-		latest, err := modproxy.Latest(mod.Path, cached, pre)
+		latest, err := modproxy.Latest(mod.Path, cached, pre, excluded)
 		if err != nil {
 			return err
 		}
+		if e := latest.Excluded; e != nil {
+			fmt.Printf("skipping excluded %s@%s\n", e.Path, e.Version)
+		}
 		version = latest.MaxVersion("", pre)
 		query = version
 	default:
@@ -202,57 +430,421 @@ func getcmd(args []string) error {
 			return fmt.Errorf("invalid version: %s", query)
 		}
 		// best effort to detect +incompatible versions
-		if v := mod.MaxVersion(query, pre); v != "" {
+		if v := mod.Exclude(excluded).MaxVersion(query, pre); v != "" {
 			version = v
 		} else {
 			version = query
 		}
 	}
-	// go get
 	spec := packages.JoinPath(modprefix, version, pkgdir)
 	if query != "" {
 		spec += "@" + query
 	}
-	fmt.Println("go get", spec)
-	cmd := exec.Command("go", "get", spec)
+	// in a workspace, every module which requires the dependency is upgraded
+	dirs, err := moduledirs(dir, modprefix, nested)
+	if err != nil {
+		return err
+	}
+	newnames := pkgnames(module.Version{
+		Path:    packages.JoinPath(modprefix, version, ""),
+		Version: version,
+	}, cached)
+	var summary []string
+	var failed bool
+	for _, dir := range dirs {
+		up := upgrade{
+			dir:       dir,
+			spec:      spec,
+			newpath:   packages.JoinPath(modprefix, version, ""),
+			rewrite:   ropt,
+			mapping:   mapping,
+			templates: templates,
+		}
+		up.rewrite.PkgDir = pkgdir
+		up.rewrite.Prefix = modprefix
+		up.rewrite.NewVersion = version
+		// find the package names so aliases can be added if they changed
+		if old, ok := required(dir, modprefix); ok {
+			up.oldpath = old.Path
+			up.rewrite.OldPkgNames = requirednames(dir, modprefix, cached)
+			up.rewrite.NewPkgNames = newnames
+		}
+		if len(dirs) == 1 {
+			_, err := getmodule(up)
+			return err
+		}
+		// keep going so the summary shows every module
+		n, err := getmodule(up)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", dir, err)
+			failed = true
+		}
+		summary = append(summary, summarize(dir, n, err))
+	}
+	fmt.Printf("%s:\n%s", modprefix, strings.Join(summary, ""))
+	if failed {
+		return fmt.Errorf("failed to upgrade all modules")
+	}
+	return nil
+}
+
+// upgrade is a dependency upgrade in a single module.
+type upgrade struct {
+	dir       string
+	spec      string // go get argument
+	oldpath   string // currently required module path
+	newpath   string
+	rewrite   importpaths.RewriteModuleOptions
+	mapping   *migrate.Mapping    // renames applied after rewriting the imports
+	templates []*migrate.Template // applied after the mapping
+}
+
+// getmodule runs go get in the directory and rewrites the imports.
+// It returns the number of rewritten imports.
+func getmodule(up upgrade) (int, error) {
+	fmt.Println("go get", up.spec)
+	cmd := exec.Command("go", "get", up.spec)
+	cmd.Dir = up.dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return 0, err
+	}
+	// keep replacements and tools pointing at the new module path
+	if up.oldpath != "" && up.oldpath != up.newpath {
+		if err := renamereplace(up.dir, up.oldpath, up.newpath); err != nil {
+			return 0, err
+		}
+		tools, err := packages.RenameTools(up.dir, up.oldpath, up.newpath)
+		if err != nil {
+			return 0, err
+		}
+		for _, tool := range tools {
+			fmt.Printf("tool %s\n", tool)
+		}
+	}
+	opt := up.rewrite
+	var n int
+	onrewrite := opt.OnRewrite
+	opt.OnRewrite = func(pos token.Position, oldpath, newpath string) error {
+		if onrewrite != nil {
+			if err := onrewrite(pos, oldpath, newpath); err != nil {
+				return err
+			}
+		}
+		n++
+		return nil
+	}
+	if err := rewritemodule(up.dir, opt); err != nil {
+		return n, fmt.Errorf("rewrite: %w", err)
+	}
+	// the mapping and templates type-check the code, which needs the new module vendored
+	if err := revendor(up.dir, up.newpath); err != nil {
+		return n, fmt.Errorf("vendor: %w", err)
+	}
+	// moved imports and rewritten call sites can use packages which aren't vendored yet
+	var moved, rewritten bool
+	if up.mapping != nil && up.mapping.Applies(up.newpath) {
+		err := migrate.Remap(up.dir, migrate.RemapOptions{
+			ModPath:     up.newpath,
+			Mapping:     up.mapping,
+			Files:       opt.Files,
+			OldPkgNames: opt.OldPkgNames,
+			NewPkgNames: opt.NewPkgNames,
+			OnRewrite: func(pos token.Position, _, newpath string) {
+				fmt.Printf("%s %s\n", relpos(pos), newpath)
+				moved = true
+			},
+			OnRename: func(pos token.Position, _, newname string) {
+				fmt.Printf("%s %s\n", relpos(pos), newname)
+			},
+			OnTypeError: func(name string, err error) {
+				fmt.Fprintf(os.Stderr, "%s: review renames: %v\n", reldir(name), err)
+			},
+		})
+		if err != nil {
+			return n, fmt.Errorf("remap: %w", err)
+		}
+	}
+	if moved {
+		if err := revendor(up.dir, up.newpath); err != nil {
+			return n, fmt.Errorf("vendor: %w", err)
+		}
+	}
+	var templates []*migrate.Template
+	for _, t := range up.templates {
+		if t.Applies(up.newpath) {
+			templates = append(templates, t)
+		}
+	}
+	if len(templates) > 0 {
+		err := migrate.ApplyTemplates(up.dir, migrate.TemplateOptions{
+			ModPath:     up.newpath,
+			Templates:   templates,
+			Files:       opt.Files,
+			LocalPrefix: opt.LocalPrefix,
+			OnRewrite: func(pos token.Position, _, new string) {
+				fmt.Printf("%s %s\n", relpos(pos), new)
+				rewritten = true
+			},
+			OnAmbiguous: func(pos token.Position, old, reason string) {
+				fmt.Fprintf(os.Stderr, "%s: review %s: %s\n", relpos(pos), old, reason)
+			},
+		})
+		if err != nil {
+			return n, fmt.Errorf("template: %w", err)
+		}
+	}
+	if rewritten {
+		if err := revendor(up.dir, up.newpath); err != nil {
+			return n, fmt.Errorf("vendor: %w", err)
+		}
+	}
+	return n, nil
+}
+
+// renamereplace renames the path-wide replace directives for oldpath in the go.mod
+// which applies to dir, and reports the version-specific ones which were skipped.
+func renamereplace(dir, oldpath, newpath string) error {
+	replaces, skipped, err := packages.RenameReplace(dir, oldpath, newpath)
+	if err != nil {
+		return err
+	}
+	for _, r := range replaces {
+		fmt.Printf("replace %s => %s\n", r.Old.Path, strings.TrimSpace(r.New.Path+" "+r.New.Version))
+	}
+	for _, r := range skipped {
+		fmt.Printf("skipping version-specific replace %s %s => %s\n",
+			r.Old.Path, r.Old.Version, strings.TrimSpace(r.New.Path+" "+r.New.Version))
+	}
+	return nil
+}
+
+// rewritemodule rewrites the imports in dir. The files with import conflicts,
+// and in tolerant mode the files which couldn't be parsed, are reported once
+// everything else is rewritten.
+func rewritemodule(dir string, opt importpaths.RewriteModuleOptions) error {
+	err := importpaths.RewriteModule(dir, opt)
+	var perrs importpaths.ParseErrors
+	var conflicts importpaths.ImportConflicts
+	parse, conflict := errors.As(err, &perrs), errors.As(err, &conflicts)
+	if !parse && !conflict {
+		return err
+	}
+	for _, e := range append(perrs, conflicts...) {
+		fmt.Fprintf(os.Stderr, "%s: skipped: %s\n", relpos(e.Pos), e.Msg)
+	}
+	return nil
+}
+
+// revendor re-runs vendoring if the module in dir is vendored.
+// If newpath isn't empty, it checks that vendor/modules.txt lists it.
+// The old path may still be vendored, because packages which weren't
+// rewritten, such as the ones outside -pkgs, can keep importing it.
+func revendor(dir, newpath string) error {
+	vendordir, ok, err := packages.VendorDir(dir)
+	if err != nil || !ok {
+		return err
+	}
+	args := []string{"mod", "vendor"}
+	if work, _ := packages.FindWorkFile(dir); work != "" {
+		args = []string{"work", "vendor"}
+	}
+	fmt.Println("go", strings.Join(args, " "))
+	cmd := exec.Command("go", args...)
 	cmd.Dir = dir
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
 		return err
 	}
-	// rewrite imports
-	err = importpaths.RewriteModule(dir, importpaths.RewriteModuleOptions{
-		PkgDir:     pkgdir,
-		Prefix:     modprefix,
-		NewVersion: version,
-		OnRewrite: func(pos token.Position, oldpath, newpath string) error {
-			if !rewrite.MatchString(oldpath) {
-				return importpaths.ErrSkip
+	if newpath == "" {
+		return nil
+	}
+	modules, err := packages.VendoredModules(vendordir)
+	if err != nil {
+		return err
+	}
+	name := reldir(filepath.Join(vendordir, "modules.txt"))
+	if _, ok := modules[newpath]; !ok {
+		return fmt.Errorf("%s doesn't list %s", name, newpath)
+	}
+	return nil
+}
+
+// summarize returns a summary line for upgrading a module in dir.
+func summarize(dir string, n int, err error) string {
+	dir = reldir(dir)
+	if err != nil {
+		return fmt.Sprintf("    %s: failed: %v\n", dir, err)
+	}
+	return fmt.Sprintf("    %s: %d imports rewritten\n", dir, n)
+}
+
+// moduledirs returns the directories to upgrade the module in.
+// In a workspace, every module which requires it is returned.
+// If nested is true, every nested module which requires it is returned.
+func moduledirs(dir, modprefix string, nested bool) ([]string, error) {
+	var moddirs []string
+	var err error
+	if nested {
+		moddirs, err = packages.Nested(dir)
+	} else {
+		moddirs, err = packages.Modules(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !nested && len(moddirs) <= 1 {
+		return []string{dir}, nil
+	}
+	if !nested {
+		members, err := packages.ModulePaths(moddirs)
+		if err != nil {
+			return nil, err
+		}
+		for modpath := range members {
+			if packages.ModPrefix(modpath) == modprefix {
+				return nil, fmt.Errorf("%s is a workspace module", modpath)
 			}
+		}
+	}
+	var dirs []string
+	for _, moddir := range moddirs {
+		if _, ok := required(moddir, modprefix); ok {
+			dirs = append(dirs, moddir)
+		}
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("no module requires %s", modprefix)
+	}
+	return dirs, nil
+}
 
-			fmt.Printf("%s %s\n", pos, newpath)
-			return nil
-		},
+// direct returns the direct and tool dependencies of every module in the workspace.
+func direct(dir string) ([]packages.Dependency, error) {
+	return dependencies(dir, false)
+}
+
+// dependencies returns the dependencies of every module in the workspace.
+// Tool dependencies are always included. If indirect is true, the indirect
+// dependencies are included along with the direct dependencies which require them.
+// Modules which are required by multiple workspace modules are only returned once,
+// and they're direct if any of the workspace modules requires them directly.
+// The workspace modules themselves are excluded, because go.work provides them.
+func dependencies(dir string, indirect bool) ([]packages.Dependency, error) {
+	moddirs, err := packages.Modules(dir)
+	if err != nil {
+		return nil, err
+	}
+	members, err := packages.ModulePaths(moddirs)
+	if err != nil {
+		return nil, err
+	}
+	var modules []packages.Dependency
+	index := map[module.Version]int{}
+	for _, moddir := range moddirs {
+		deps, err := packages.Requirements(moddir)
+		if err != nil {
+			return nil, err
+		}
+		tools, err := packages.Tools(moddir)
+		if err != nil {
+			return nil, err
+		}
+		packages.MarkTools(deps, tools)
+		deps = slices.DeleteFunc(deps, func(d packages.Dependency) bool {
+			return members[d.Path]
+		})
+		if !indirect {
+			deps = slices.DeleteFunc(deps, func(d packages.Dependency) bool {
+				return d.Indirect && !d.Tool
+			})
+		}
+		if indirect && slices.ContainsFunc(deps, func(d packages.Dependency) bool { return d.Indirect }) {
+			// the graph is only used for annotations, so failing to load it isn't fatal
+			graph, err := packages.LoadGraph(moddir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", moddir, err)
+			}
+			for i, d := range deps {
+				if d.Indirect && graph != nil {
+					deps[i].Via = graph.Via(deps, d.Path)
+				}
+			}
+		}
+		for _, m := range deps {
+			i, ok := index[m.Module()]
+			if ok && m.Tool {
+				modules[i].Tool = true
+			}
+			switch {
+			case !ok:
+				index[m.Module()] = len(modules)
+				modules = append(modules, m)
+			case !m.Indirect:
+				modules[i].Indirect = false
+				modules[i].Via = nil
+			case modules[i].Indirect:
+				for _, via := range m.Via {
+					if !slices.Contains(modules[i].Via, via) {
+						modules[i].Via = append(modules[i].Via, via)
+					}
+				}
+			}
+		}
+	}
+	sort.Slice(modules, func(i, j int) bool {
+		if modules[i].Path != modules[j].Path {
+			return modules[i].Path < modules[j].Path
+		}
+		return semver.Compare(modules[i].Version, modules[j].Version) < 0
 	})
+	return modules, nil
+}
+
+// exclusions returns the versions excluded by the modules in the workspace.
+func exclusions(dir string) (modproxy.Exclusions, error) {
+	moddirs, err := packages.Modules(dir)
 	if err != nil {
-		return fmt.Errorf("rewrite: %w", err)
+		return nil, err
 	}
-	return nil
+	var excluded modproxy.Exclusions
+	for _, moddir := range moddirs {
+		e, err := packages.Excluded(moddir)
+		if err != nil {
+			return nil, err
+		}
+		excluded = append(excluded, e...)
+	}
+	return excluded, nil
 }
 
 func pathcmd(args []string) error {
-	var dir, version string
-	var next bool
+	var dir, version, local, text, pkgs, tags string
+	var next, rename, proto, testdata, tolerant bool
 	fset := flag.NewFlagSet("path", flag.ExitOnError)
 	fset.BoolVar(&next, "next", false, "increment the module path version")
+	fset.BoolVar(&rename, "rename", false, "rename the root package to match the new module path")
 	fset.StringVar(&version, "version", "", "set the module path version")
 	fset.StringVar(&dir, "dir", ".", "working directory")
+	fset.StringVar(&local, "local", "", "put imports beginning with this string after 3rd-party packages; comma-separated list")
+	fset.BoolVar(&proto, "proto", false, "also rewrite go_package options in .proto files")
+	fset.StringVar(&text, "text", "", "also rewrite package paths in non-Go files matching these globs; comma-separated list")
+	fset.BoolVar(&testdata, "testdata", false, "also rewrite testdata directories, including txtar archives")
+	fset.BoolVar(&tolerant, "e", false, "report files which can't be parsed instead of stopping")
+	fset.StringVar(&pkgs, "pkgs", "", "only rewrite the Go files of packages matching these patterns; comma-separated list")
+	fset.StringVar(&tags, "tags", "", "build tags used to resolve -pkgs; comma-separated list")
 	fset.Usage = func() {
 		fmt.Fprintln(os.Stderr, "Usage: gomajor path [modpath]")
 		fset.PrintDefaults()
 	}
 	fset.Parse(args)
+	// resolve the packages before their imports change
+	files, err := scope(dir, pkgs, tags)
+	if err != nil {
+		return err
+	}
 	// find and parse go.mod
 	name, err := packages.FindModFile(dir)
 	if err != nil {
@@ -294,25 +886,295 @@ func pathcmd(args []string) error {
 	oldmodprefix := packages.ModPrefix(file.Module.Mod.Path)
 	modpath = packages.JoinPath(modprefix, version, "")
 	fmt.Printf("module %s\n", modpath)
+	// find the other modules in the workspace
+	moddir := filepath.Dir(name)
+	moddirs, err := packages.Modules(moddir)
+	if err != nil {
+		return err
+	}
+	// find the root package renames while the packages still type-check
+	var renames refactor.Editor
+	if rename {
+		for _, d := range moddirs {
+			err := refactor.RenamePackage(&renames, d, refactor.RenamePackageOptions{
+				PkgPath: file.Module.Mod.Path,
+				NewName: packages.GuessName(modprefix),
+			})
+			if err != nil {
+				return fmt.Errorf("rename: %w", err)
+			}
+		}
+	}
 	// update go.mod
 	cmd := exec.Command("go", "mod", "edit", "-module", modpath)
+	cmd.Dir = moddir
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
 		return err
 	}
+	// the renames are written before the imports change their offsets
+	err = renames.Write(func(pos token.Position, _, newname string) {
+		fmt.Printf("%s %s\n", relpos(pos), newname)
+	})
+	if err != nil {
+		// restore the module path so the command can be retried
+		return errors.Join(fmt.Errorf("rename: %w", err), os.WriteFile(name, data, 0))
+	}
 	// rewrite import paths
-	err = importpaths.RewriteModule(dir, importpaths.RewriteModuleOptions{
+	opt := importpaths.RewriteModuleOptions{
+		CommonOptions: importpaths.CommonOptions{
+			LocalPrefix: local,
+			Proto:       proto,
+			Text:        commaList(text),
+			Testdata:    testdata,
+			Tolerant:    tolerant,
+			Files:       files,
+		},
 		Prefix:     oldmodprefix,
 		NewVersion: version,
 		NewPrefix:  modprefix,
 		OnRewrite: func(pos token.Position, _, newpath string) error {
-			fmt.Printf("%s %s\n", pos, newpath)
+			fmt.Printf("%s %s\n", relpos(pos), newpath)
 			return nil
 		},
+	}
+	if err := rewritemodule(dir, opt); err != nil {
+		return fmt.Errorf("rewrite: %w", err)
+	}
+	// update the other workspace modules which use this one
+	// the -pkgs scope was resolved in this module, so it doesn't apply to them
+	opt.Files = nil
+	var errs []error
+	for _, d := range moddirs {
+		if d == moddir {
+			continue
+		}
+		// the requirement can't be renamed if its version isn't valid for the new path,
+		// but go.work still provides the module, so the imports are rewritten anyway
+		if _, err := packages.RenameRequire(d, file.Module.Mod.Path, modpath); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", reldir(d), err))
+		}
+		if err := renamereplace(d, file.Module.Mod.Path, modpath); err != nil {
+			return err
+		}
+		if err := rewritemodule(d, opt); err != nil {
+			return fmt.Errorf("rewrite: %w", err)
+		}
+	}
+	if err := revendor(dir, ""); err != nil {
+		return fmt.Errorf("vendor: %w", err)
+	}
+	return errors.Join(errs...)
+}
+
+// commaList splits the comma-separated list, such as glob or package patterns.
+func commaList(list string) []string {
+	var patterns []string
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// scope returns the Go files of the packages matching the comma-separated
+// patterns, or nil if there aren't any patterns.
+func scope(dir, pkgs, tags string) ([]string, error) {
+	patterns := commaList(pkgs)
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	files, err := packages.ListFiles(dir, tags, patterns)
+	if err != nil {
+		return nil, err
+	}
+	if files == nil {
+		files = []string{}
+	}
+	return files, nil
+}
+
+// relpos returns the position with a filename relative to the working directory.
+func relpos(pos token.Position) token.Position {
+	pos.Filename = reldir(pos.Filename)
+	return pos
+}
+
+// reldir returns the path relative to the working directory if possible.
+func reldir(path string) string {
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, path); err == nil {
+			return rel
+		}
+	}
+	return path
+}
+
+// required returns the highest version of the module prefix required by go.mod.
+func required(dir, modprefix string) (packages.Dependency, bool) {
+	modules, err := packages.Requirements(dir)
+	if err != nil {
+		return packages.Dependency{}, false
+	}
+	var found packages.Dependency
+	var ok bool
+	for _, m := range modules {
+		if packages.ModPrefix(m.Path) == modprefix && (!ok || modproxy.CompareVersion(found.Version, m.Version) < 0) {
+			found, ok = m, true
+		}
+	}
+	return found, ok
+}
+
+// requirednames returns the package names declared by every required
+// major version of the module, keyed by import path.
+func requirednames(dir, modprefix string, cached bool) map[string]string {
+	modules, err := packages.Requirements(dir)
+	if err != nil {
+		return nil
+	}
+	names := map[string]string{}
+	for _, m := range modules {
+		if packages.ModPrefix(m.Path) == modprefix {
+			maps.Copy(names, pkgnames(m.Module(), cached))
+		}
+	}
+	return names
+}
+
+// pkgnames returns the package names declared by the module version, keyed by import path.
+// Errors are reported, but they aren't fatal.
+func pkgnames(mod module.Version, cached bool) map[string]string {
+	names, err := modproxy.PackageNames(mod, cached)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s@%s: package names: %v\n", mod.Path, mod.Version, err)
+		return nil
+	}
+	paths := map[string]string{}
+	for pkgdir, name := range names {
+		paths[path.Join(mod.Path, pkgdir)] = name
+	}
+	return paths
+}
+
+func usagecmd(args []string) error {
+	var dir, pkgs string
+	var jsonfmt bool
+	fset := flag.NewFlagSet("usage", flag.ExitOnError)
+	fset.StringVar(&dir, "dir", ".", "working directory")
+	fset.StringVar(&pkgs, "pkgs", "./...", "package patterns to check; comma-separated list")
+	fset.BoolVar(&jsonfmt, "json", false, "output json format")
+	fset.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gomajor usage <module>")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() != 1 {
+		return fmt.Errorf("missing module path")
+	}
+	importers, err := usage.Find(dir, usage.Options{
+		ModPath:  fset.Arg(0),
+		Patterns: commaList(pkgs),
 	})
 	if err != nil {
-		return fmt.Errorf("rewrite: %w", err)
+		return err
+	}
+	if jsonfmt {
+		data, err := json.MarshalIndent(importers, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	for _, importer := range importers {
+		fmt.Println(importer.PkgPath)
+		for _, imp := range importer.Imports {
+			fmt.Printf("\t%s%s\n", imp.Path, positions(imp.Positions, " (", ")"))
+			for _, sym := range imp.Symbols {
+				fmt.Printf("\t\t%s %d%s\n", sym.Name, len(sym.Positions), positions(sym.Positions, ": ", ""))
+			}
+		}
+	}
+	return nil
+}
+
+// positions formats the positions relative to the working directory.
+// It returns an empty string if there are no positions.
+func positions(positions []token.Position, prefix, suffix string) string {
+	if len(positions) == 0 {
+		return ""
+	}
+	var list []string
+	for _, pos := range positions {
+		list = append(list, relpos(pos).String())
+	}
+	return prefix + strings.Join(list, ", ") + suffix
+}
+
+func diffcmd(args []string) error {
+	var cached, jsonfmt, incompatible bool
+	fset := flag.NewFlagSet("diff", flag.ExitOnError)
+	fset.BoolVar(&cached, "cached", true, "only fetch cached content from the module proxy")
+	fset.BoolVar(&jsonfmt, "json", false, "output json format")
+	fset.BoolVar(&incompatible, "incompatible", false, "only show incompatible changes")
+	fset.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gomajor diff <module>@<old> <module>@<new>")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() != 2 {
+		return fmt.Errorf("expected two module versions")
+	}
+	var mods [2]module.Version
+	for i, arg := range fset.Args() {
+		modpath, version, ok := strings.Cut(arg, "@")
+		if !ok || !semver.IsValid(version) {
+			return fmt.Errorf("invalid module version: %q", arg)
+		}
+		mods[i] = module.Version{Path: modpath, Version: version}
+	}
+	var apis [2]apidiff.Module
+	for i, mod := range mods {
+		api, err := apidiff.Fetch(mod, cached)
+		if err != nil {
+			return fmt.Errorf("%s@%s: %w", mod.Path, mod.Version, err)
+		}
+		apis[i] = api
+	}
+	diffs := apidiff.Diff(apis[0], apis[1])
+	if incompatible {
+		var filtered []apidiff.Package
+		for _, d := range diffs {
+			if changes := d.Incompatible(); len(changes) > 0 {
+				filtered = append(filtered, apidiff.Package{Dir: d.Dir, Changes: changes})
+			}
+		}
+		diffs = filtered
+	}
+	if jsonfmt {
+		data, err := json.MarshalIndent(diffs, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	for _, d := range diffs {
+		pkgpath := mods[1].Path
+		if d.Dir != "" {
+			pkgpath += "/" + d.Dir
+		}
+		fmt.Println(pkgpath)
+		for _, c := range d.Changes {
+			compat := "incompatible"
+			if c.Compatible {
+				compat = "compatible"
+			}
+			fmt.Printf("\t%s %s\n", compat, c)
+		}
 	}
 	return nil
 }
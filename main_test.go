@@ -32,6 +32,54 @@ func TestListCommand(t *testing.T) {
 	})
 }
 
+func TestGetCommand(t *testing.T) {
+	testscript.Run(t, testscript.Params{
+		Dir: "testdata/testscript/get",
+		Setup: func(env *testscript.Env) error {
+			proxyfs, err := testmodproxy.LoadFS("testdata/modules")
+			if err != nil {
+				return err
+			}
+			server := httptest.NewServer(http.FileServer(http.FS(proxyfs)))
+			env.Vars = append(env.Vars, "GOPROXY="+server.URL)
+			env.Defer(func() { server.Close() })
+			return nil
+		},
+	})
+}
+
+func TestUsageCommand(t *testing.T) {
+	testscript.Run(t, testscript.Params{
+		Dir: "testdata/testscript/usage",
+		Setup: func(env *testscript.Env) error {
+			proxyfs, err := testmodproxy.LoadFS("testdata/modules")
+			if err != nil {
+				return err
+			}
+			server := httptest.NewServer(http.FileServer(http.FS(proxyfs)))
+			env.Vars = append(env.Vars, "GOPROXY="+server.URL)
+			env.Defer(func() { server.Close() })
+			return nil
+		},
+	})
+}
+
+func TestDiffCommand(t *testing.T) {
+	testscript.Run(t, testscript.Params{
+		Dir: "testdata/testscript/diff",
+		Setup: func(env *testscript.Env) error {
+			proxyfs, err := testmodproxy.LoadFS("testdata/modules")
+			if err != nil {
+				return err
+			}
+			server := httptest.NewServer(http.FileServer(http.FS(proxyfs)))
+			env.Vars = append(env.Vars, "GOPROXY="+server.URL)
+			env.Defer(func() { server.Close() })
+			return nil
+		},
+	})
+}
+
 func TestHelpCommand(t *testing.T) {
 	testscript.Run(t, testscript.Params{
 		Dir: "testdata/testscript/help",
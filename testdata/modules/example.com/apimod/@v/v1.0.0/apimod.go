@@ -0,0 +1,24 @@
+package apimod
+
+// Version is the module version.
+const Version = "v1"
+
+// Client is a key-value client.
+type Client struct {
+	Addr string
+}
+
+// New returns a client for the address.
+func New(addr string) *Client {
+	return &Client{Addr: addr}
+}
+
+// Get returns the value of the key.
+func (c *Client) Get(key string) string {
+	return c.Addr + "/" + key
+}
+
+// Close closes the client.
+func (c *Client) Close() error {
+	return nil
+}
@@ -0,0 +1,6 @@
+package util
+
+// Join joins the keys.
+func Join(a, b string) string {
+	return a + "/" + b
+}
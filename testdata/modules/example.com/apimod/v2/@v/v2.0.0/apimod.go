@@ -0,0 +1,31 @@
+package apimod
+
+import "context"
+
+// Version is the module version.
+const Version = "v2"
+
+// Client is a key-value client.
+type Client struct {
+	Addr string
+}
+
+// New returns a client for the address.
+func New(ctx context.Context, addr string) *Client {
+	return &Client{Addr: addr}
+}
+
+// Get returns the value of the key.
+func (c *Client) Get(ctx context.Context, key string) string {
+	return c.Addr + "/" + key
+}
+
+// Close closes the client.
+func (c *Client) Close() error {
+	return nil
+}
+
+// Ping checks the connection.
+func (c *Client) Ping(ctx context.Context) error {
+	return nil
+}
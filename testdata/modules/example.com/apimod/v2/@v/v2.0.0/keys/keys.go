@@ -0,0 +1,6 @@
+package keys
+
+// Concat joins the keys.
+func Concat(a, b string) string {
+	return a + "/" + b
+}
@@ -0,0 +1,6 @@
+package util
+
+// Concat joins the keys.
+func Concat(a, b string) string {
+	return a + "/" + b
+}
@@ -0,0 +1,5 @@
+module example.com/depmod
+
+go 1.19
+
+require example.com/testmod v1.0.0
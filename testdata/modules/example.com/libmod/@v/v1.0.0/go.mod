@@ -0,0 +1,3 @@
+module example.com/libmod
+
+go 1.19
@@ -0,0 +1,3 @@
+module example.com/libmod/v2
+
+go 1.19
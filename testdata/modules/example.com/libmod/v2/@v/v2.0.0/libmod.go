@@ -0,0 +1,4 @@
+package libmod
+
+// Version is the module version.
+const Version = "v2.0.0"